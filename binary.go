@@ -0,0 +1,559 @@
+package minimemcached
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+)
+
+const (
+	binaryHeaderSize = 24
+	binaryReqMagic   = 0x80
+	binaryResMagic   = 0x81
+
+	// binaryNoAutoCreate is the expiration of an increment or decrement request
+	// which must not create a missing item.
+	binaryNoAutoCreate = 0xffffffff
+)
+
+// binary protocol opcodes.
+const (
+	opGet       byte = 0x00
+	opSet       byte = 0x01
+	opAdd       byte = 0x02
+	opReplace   byte = 0x03
+	opDelete    byte = 0x04
+	opIncrement byte = 0x05
+	opDecrement byte = 0x06
+	opQuit      byte = 0x07
+	opFlush     byte = 0x08
+	opNoop      byte = 0x0a
+	opVersion   byte = 0x0b
+	opGetK      byte = 0x0c
+	opAppend    byte = 0x0e
+	opPrepend   byte = 0x0f
+	opStat      byte = 0x10
+	opTouch     byte = 0x1c
+	opGAT       byte = 0x1d
+
+	opGetQ       byte = 0x09
+	opGetKQ      byte = 0x0d
+	opSetQ       byte = 0x11
+	opAddQ       byte = 0x12
+	opReplaceQ   byte = 0x13
+	opDeleteQ    byte = 0x14
+	opIncrementQ byte = 0x15
+	opDecrementQ byte = 0x16
+	opQuitQ      byte = 0x17
+	opFlushQ     byte = 0x18
+	opAppendQ    byte = 0x19
+	opPrependQ   byte = 0x1a
+	opGATQ       byte = 0x1e
+
+	opSASLListMechs byte = 0x20
+	opSASLAuth      byte = 0x21
+	opSASLStep      byte = 0x22
+)
+
+// binaryQuietOpcodes are the opcodes of quiet requests, mapped to the opcodes of their loud versions.
+// Quiet retrievals only respond on hits, and the other quiet requests only respond on errors.
+var binaryQuietOpcodes = map[byte]byte{
+	opGetQ:       opGet,
+	opGetKQ:      opGetK,
+	opSetQ:       opSet,
+	opAddQ:       opAdd,
+	opReplaceQ:   opReplace,
+	opDeleteQ:    opDelete,
+	opIncrementQ: opIncrement,
+	opDecrementQ: opDecrement,
+	opQuitQ:      opQuit,
+	opFlushQ:     opFlush,
+	opAppendQ:    opAppend,
+	opPrependQ:   opPrepend,
+	opGATQ:       opGAT,
+}
+
+// binary protocol response statuses.
+const (
+	statusNoError     uint16 = 0x0000
+	statusKeyNotFound uint16 = 0x0001
+	statusKeyExists   uint16 = 0x0002
+	statusTooLarge    uint16 = 0x0003
+	statusInvalidArgs uint16 = 0x0004
+	statusNotStored   uint16 = 0x0005
+	statusNonNumeric  uint16 = 0x0006
+	statusAuthError   uint16 = 0x0020
+	statusUnknownCmd  uint16 = 0x0081
+	statusOutOfMemory uint16 = 0x0082
+)
+
+const (
+	// saslMechanisms are the SASL mechanisms supported by mini-memcached.
+	saslMechanisms = "PLAIN"
+	// saslAuthenticated is the body of a successful SASL authentication response.
+	saslAuthenticated = "Authenticated"
+)
+
+// binaryStatusMessages are the bodies of error responses for each status.
+var binaryStatusMessages = map[uint16]string{
+	statusKeyNotFound: "Not found",
+	statusKeyExists:   "Data exists for key.",
+	statusTooLarge:    "Too large.",
+	statusInvalidArgs: "Invalid arguments",
+	statusNotStored:   "Not stored.",
+	statusNonNumeric:  "Non-numeric server-side value for incr or decr",
+	statusAuthError:   "Auth failure.",
+	statusUnknownCmd:  "Unknown command",
+	statusOutOfMemory: "Out of memory",
+}
+
+// binaryUnauthenticatedOpcodes are the opcodes which can be requested before authentication.
+var binaryUnauthenticatedOpcodes = map[byte]bool{
+	opSASLListMechs: true,
+	opSASLAuth:      true,
+	opSASLStep:      true,
+	opVersion:       true,
+}
+
+// binaryStoreStatuses are the response statuses of binary storage commands for each storeResult.
+var binaryStoreStatuses = map[storeResult]uint16{
+	storeStored:      statusNoError,
+	storeNotStored:   statusNotStored,
+	storeExists:      statusKeyExists,
+	storeNotFound:    statusKeyNotFound,
+	storeNonNumeric:  statusNonNumeric,
+	storeOutOfMemory: statusOutOfMemory,
+	storeTooLarge:    statusTooLarge,
+}
+
+// binaryRequest is a request of memcached binary protocol.
+type binaryRequest struct {
+	opcode byte
+	opaque uint32
+	cas    uint64
+	extras []byte
+	key    string
+	value  []byte
+}
+
+// binaryResponse is a response of memcached binary protocol.
+type binaryResponse struct {
+	opcode byte
+	status uint16
+	opaque uint32
+	cas    uint64
+	extras []byte
+	key    string
+	value  []byte
+}
+
+// readBinaryRequest() reads a binary protocol request from reader.
+// The value of a request larger than maxValueLength is discarded without being buffered,
+// and the request is returned without it along with errObjectTooLarge.
+func readBinaryRequest(reader *bufio.Reader, maxValueLength int) (*binaryRequest, error) {
+	header := make([]byte, binaryHeaderSize)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	if header[0] != binaryReqMagic {
+		return nil, errBadDataChunk
+	}
+
+	keyLength := int(binary.BigEndian.Uint16(header[2:4]))
+	extrasLength := int(header[4])
+	bodyLength := int(binary.BigEndian.Uint32(header[8:12]))
+	if keyLength+extrasLength > bodyLength {
+		return nil, errBadDataChunk
+	}
+
+	req := &binaryRequest{
+		opcode: header[1],
+		opaque: binary.BigEndian.Uint32(header[12:16]),
+		cas:    binary.BigEndian.Uint64(header[16:24]),
+	}
+	valueLength := bodyLength - keyLength - extrasLength
+	tooLarge := valueLength > maxValueLength
+	if tooLarge {
+		valueLength = 0
+	}
+
+	body := make([]byte, extrasLength+keyLength+valueLength)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, err
+	}
+	req.extras = body[:extrasLength]
+	req.key = string(body[extrasLength : extrasLength+keyLength])
+	req.value = body[extrasLength+keyLength:]
+	if tooLarge {
+		if _, err := io.CopyN(io.Discard, reader, int64(bodyLength-len(body))); err != nil {
+			return nil, err
+		}
+		return req, errObjectTooLarge
+	}
+	return req, nil
+}
+
+// writeBinaryResponse() writes a binary protocol response to w.
+func writeBinaryResponse(w io.Writer, res *binaryResponse) {
+	header := make([]byte, binaryHeaderSize)
+	header[0] = binaryResMagic
+	header[1] = res.opcode
+	binary.BigEndian.PutUint16(header[2:4], uint16(len(res.key)))
+	header[4] = byte(len(res.extras))
+	binary.BigEndian.PutUint16(header[6:8], res.status)
+	binary.BigEndian.PutUint32(header[8:12], uint32(len(res.extras)+len(res.key)+len(res.value)))
+	binary.BigEndian.PutUint32(header[12:16], res.opaque)
+	binary.BigEndian.PutUint64(header[16:24], res.cas)
+
+	result := append(header, res.extras...)
+	result = append(result, res.key...)
+	result = append(result, res.value...)
+	_, _ = w.Write(result)
+}
+
+// serveBinary() serves binary protocol requests from a client connection.
+// When SASL credentials are configured, every request but the ones in binaryUnauthenticatedOpcodes
+// fails until the client authenticates.
+func (m *MiniMemcached) serveBinary(c *connection, reader *bufio.Reader, writer *bufio.Writer) {
+	authenticated := m.saslCredentials == nil
+	for {
+		m.setConnState(c, connWaiting)
+		if reader.Buffered() == 0 {
+			if err := writer.Flush(); err != nil {
+				return
+			}
+		}
+
+		req, err := readBinaryRequest(reader, m.maxItemSize)
+		if errors.Is(err, errObjectTooLarge) {
+			// A Set too large for the cache removes the item under its key, as store() does.
+			if authenticated && (req.opcode == opSet || req.opcode == opSetQ) && req.cas == 0 {
+				m.mu.Lock()
+				m.unlinkTooLarge(req.key)
+				m.mu.Unlock()
+			}
+			writeBinaryResponse(writer, binaryError(req, statusTooLarge))
+			continue
+		}
+		if err != nil {
+			return
+		}
+		m.setConnState(c, connParseCmd)
+
+		var responses []*binaryResponse
+		switch {
+		case m.saslCredentials != nil && (req.opcode == opSASLAuth || req.opcode == opSASLStep):
+			res := m.binarySASLAuth(req)
+			authenticated = res.status == statusNoError
+			responses = []*binaryResponse{res}
+		case m.saslCredentials != nil && req.opcode == opSASLListMechs:
+			responses = []*binaryResponse{{opcode: req.opcode, opaque: req.opaque, value: []byte(saslMechanisms)}}
+		case !authenticated && !binaryUnauthenticatedOpcodes[req.opcode]:
+			responses = []*binaryResponse{binaryError(req, statusAuthError)}
+		default:
+			responses = m.handleBinary(req)
+		}
+		for _, res := range responses {
+			writeBinaryResponse(writer, res)
+		}
+		if req.opcode == opQuit || req.opcode == opQuitQ {
+			_ = writer.Flush()
+			return
+		}
+	}
+}
+
+// handleBinary() handles a binary protocol request, and returns the responses to it.
+func (m *MiniMemcached) handleBinary(req *binaryRequest) []*binaryResponse {
+	if opcode, ok := binaryQuietOpcodes[req.opcode]; ok {
+		return m.handleBinaryQuiet(req, opcode)
+	}
+
+	var res *binaryResponse
+	switch req.opcode {
+	case opGet, opGetK:
+		res = m.binaryGet(req)
+	case opSet, opAdd, opReplace:
+		res = m.binaryStore(req)
+	case opAppend, opPrepend:
+		res = m.binaryConcat(req)
+	case opDelete:
+		res = m.binaryDelete(req)
+	case opIncrement, opDecrement:
+		res = m.binaryDelta(req)
+	case opTouch, opGAT:
+		res = m.binaryTouch(req)
+	case opFlush:
+		res = m.binaryFlush(req)
+	case opNoop, opQuit:
+		res = binaryEmpty(req)
+	case opVersion:
+		res = m.binaryVersion(req)
+	case opStat:
+		return m.binaryStat(req)
+	default:
+		res = binaryError(req, statusUnknownCmd)
+	}
+	return []*binaryResponse{res}
+}
+
+// handleBinaryQuiet() handles a quiet binary protocol request as the request of opcode,
+// and returns only the responses which must not be suppressed.
+func (m *MiniMemcached) handleBinaryQuiet(req *binaryRequest, opcode byte) []*binaryResponse {
+	loudReq := *req
+	loudReq.opcode = opcode
+	retrieval := opcode == opGet || opcode == opGetK || opcode == opGAT
+
+	var responses []*binaryResponse
+	for _, res := range m.handleBinary(&loudReq) {
+		if retrieval && res.status == statusKeyNotFound || !retrieval && res.status == statusNoError {
+			continue
+		}
+		res.opcode = req.opcode
+		responses = append(responses, res)
+	}
+	return responses
+}
+
+// binaryError() returns an error response to req.
+func binaryError(req *binaryRequest, status uint16) *binaryResponse {
+	return &binaryResponse{
+		opcode: req.opcode,
+		status: status,
+		opaque: req.opaque,
+		value:  []byte(binaryStatusMessages[status]),
+	}
+}
+
+// binaryEmpty() returns a successful response without a body to req.
+func binaryEmpty(req *binaryRequest) *binaryResponse {
+	if len(req.extras) != 0 || len(req.key) != 0 || len(req.value) != 0 {
+		return binaryError(req, statusInvalidArgs)
+	}
+	return &binaryResponse{opcode: req.opcode, opaque: req.opaque}
+}
+
+// binaryItem() returns a response carrying it to req.
+func binaryItem(req *binaryRequest, it item, withKey bool, withValue bool) *binaryResponse {
+	res := &binaryResponse{
+		opcode: req.opcode,
+		opaque: req.opaque,
+		cas:    it.casToken,
+		extras: make([]byte, 4),
+	}
+	binary.BigEndian.PutUint32(res.extras, it.flags)
+	if withKey {
+		res.key = req.key
+	}
+	if withValue {
+		res.value = it.value
+	}
+	return res
+}
+
+// binaryGet() handles binary protocol Get and GetK requests.
+func (m *MiniMemcached) binaryGet(req *binaryRequest) *binaryResponse {
+	if len(req.extras) != 0 || len(req.value) != 0 || !isLegalKey(req.key) || req.key == "" {
+		return binaryError(req, statusInvalidArgs)
+	}
+
+	it, ok := m.fetch(req.key)
+	if !ok {
+		if req.opcode == opGetK {
+			return &binaryResponse{opcode: req.opcode, status: statusKeyNotFound, opaque: req.opaque, key: req.key}
+		}
+		return binaryError(req, statusKeyNotFound)
+	}
+	return binaryItem(req, it, req.opcode == opGetK, true)
+}
+
+// binaryStore() handles binary protocol Set, Add and Replace requests.
+func (m *MiniMemcached) binaryStore(req *binaryRequest) *binaryResponse {
+	if len(req.extras) != 8 || !isLegalKey(req.key) || req.key == "" {
+		return binaryError(req, statusInvalidArgs)
+	}
+
+	now := m.clock.Now().Unix()
+	it := &item{
+		flags:          binary.BigEndian.Uint32(req.extras[0:4]),
+		value:          req.value,
+		expiresAt:      deadline(int64(binary.BigEndian.Uint32(req.extras[4:8])), now),
+		lastAccessedAt: now,
+	}
+
+	var res storeResult
+	switch req.opcode {
+	case opSet:
+		if req.cas != 0 {
+			res = m.store(modeCAS, req.key, it, req.cas, false)
+		} else {
+			res = m.store(modeSet, req.key, it, 0, false)
+		}
+	case opAdd:
+		if res = m.store(modeAdd, req.key, it, 0, false); res == storeNotStored {
+			res = storeExists
+		}
+	case opReplace:
+		if res = m.store(modeReplace, req.key, it, req.cas, false); res == storeNotStored {
+			res = storeNotFound
+		}
+	}
+	if res != storeStored {
+		return binaryError(req, binaryStoreStatuses[res])
+	}
+	return &binaryResponse{opcode: req.opcode, opaque: req.opaque, cas: it.casToken}
+}
+
+// binaryConcat() handles binary protocol Append and Prepend requests.
+func (m *MiniMemcached) binaryConcat(req *binaryRequest) *binaryResponse {
+	if len(req.extras) != 0 || !isLegalKey(req.key) || req.key == "" {
+		return binaryError(req, statusInvalidArgs)
+	}
+
+	mode := modeAppend
+	if req.opcode == opPrepend {
+		mode = modePrepend
+	}
+	it := &item{value: req.value}
+	if res := m.store(mode, req.key, it, req.cas, false); res != storeStored {
+		return binaryError(req, binaryStoreStatuses[res])
+	}
+	return &binaryResponse{opcode: req.opcode, opaque: req.opaque, cas: it.casToken}
+}
+
+// binaryDelete() handles binary protocol Delete requests.
+func (m *MiniMemcached) binaryDelete(req *binaryRequest) *binaryResponse {
+	if len(req.extras) != 0 || len(req.value) != 0 || !isLegalKey(req.key) || req.key == "" {
+		return binaryError(req, statusInvalidArgs)
+	}
+
+	if res := m.remove(req.key, req.cas, false); res != storeStored {
+		return binaryError(req, binaryStoreStatuses[res])
+	}
+	return &binaryResponse{opcode: req.opcode, opaque: req.opaque}
+}
+
+// binaryDelta() handles binary protocol Increment and Decrement requests.
+// A missing item is created with the initial value, unless the expiration is binaryNoAutoCreate.
+func (m *MiniMemcached) binaryDelta(req *binaryRequest) *binaryResponse {
+	if len(req.extras) != 20 || len(req.value) != 0 || !isLegalKey(req.key) || req.key == "" {
+		return binaryError(req, statusInvalidArgs)
+	}
+
+	delta := binary.BigEndian.Uint64(req.extras[0:8])
+	initial := binary.BigEndian.Uint64(req.extras[8:16])
+	expiration := binary.BigEndian.Uint32(req.extras[16:20])
+
+	it, res := m.applyDelta(req.key, req.opcode == opIncrement, delta, req.cas)
+	if res == storeNotFound && expiration != binaryNoAutoCreate {
+		now := m.clock.Now().Unix()
+		created := &item{
+			value:          []byte(strconv.FormatUint(initial, 10)),
+			expiresAt:      deadline(int64(expiration), now),
+			lastAccessedAt: now,
+		}
+		if res = m.store(modeAdd, req.key, created, 0, false); res == storeStored {
+			it = *created
+		}
+	}
+	if res != storeStored {
+		return binaryError(req, binaryStoreStatuses[res])
+	}
+
+	value, _ := getNumericValueFromByteArray(it.value)
+	result := &binaryResponse{opcode: req.opcode, opaque: req.opaque, cas: it.casToken, value: make([]byte, 8)}
+	binary.BigEndian.PutUint64(result.value, value)
+	return result
+}
+
+// binaryTouch() handles binary protocol Touch and GAT requests.
+func (m *MiniMemcached) binaryTouch(req *binaryRequest) *binaryResponse {
+	if len(req.extras) != 4 || len(req.value) != 0 || !isLegalKey(req.key) || req.key == "" {
+		return binaryError(req, statusInvalidArgs)
+	}
+
+	exptime := int64(binary.BigEndian.Uint32(req.extras))
+	if req.opcode == opGAT {
+		it, ok := m.fetchAndTouch(req.key, exptime)
+		if !ok {
+			return binaryError(req, statusKeyNotFound)
+		}
+		return binaryItem(req, it, false, true)
+	}
+	// A plain Touch is not counted as a get.
+	if res := m.touchItem(req.key, exptime); res != storeStored {
+		return binaryError(req, binaryStoreStatuses[res])
+	}
+	it, ok := m.peek(req.key)
+	if !ok {
+		return binaryError(req, statusKeyNotFound)
+	}
+	return binaryItem(req, it, false, false)
+}
+
+// binaryFlush() handles binary protocol Flush requests.
+func (m *MiniMemcached) binaryFlush(req *binaryRequest) *binaryResponse {
+	if (len(req.extras) != 0 && len(req.extras) != 4) || len(req.key) != 0 || len(req.value) != 0 {
+		return binaryError(req, statusInvalidArgs)
+	}
+
+	var delay int64
+	if len(req.extras) == 4 {
+		delay = int64(int32(binary.BigEndian.Uint32(req.extras)))
+	}
+	m.scheduleFlush(delay)
+	return &binaryResponse{opcode: req.opcode, opaque: req.opaque}
+}
+
+// binaryVersion() handles binary protocol Version requests.
+func (m *MiniMemcached) binaryVersion(req *binaryRequest) *binaryResponse {
+	res := binaryEmpty(req)
+	if res.status == statusNoError {
+		res.value = []byte(Version)
+	}
+	return res
+}
+
+// binaryStat() handles binary protocol Stat requests.
+// Each statistic is returned in its own response, followed by a response without a key.
+func (m *MiniMemcached) binaryStat(req *binaryRequest) []*binaryResponse {
+	if len(req.extras) != 0 || len(req.value) != 0 {
+		return []*binaryResponse{binaryError(req, statusInvalidArgs)}
+	}
+	if req.key == statsReset {
+		m.resetStats()
+		return []*binaryResponse{{opcode: req.opcode, opaque: req.opaque}}
+	}
+
+	stats, ok := m.statsGroup(req.key)
+	if !ok {
+		return []*binaryResponse{binaryError(req, statusKeyNotFound)}
+	}
+	responses := make([]*binaryResponse, 0, len(stats)+1)
+	for _, s := range stats {
+		responses = append(responses, &binaryResponse{opcode: req.opcode, opaque: req.opaque, key: s.name, value: []byte(s.value)})
+	}
+	return append(responses, &binaryResponse{opcode: req.opcode, opaque: req.opaque})
+}
+
+// binarySASLAuth() handles binary protocol SASL Auth and SASL Step requests.
+// The value of a SASL PLAIN request is made of an authorization identity, a username and a password,
+// separated by NUL.
+func (m *MiniMemcached) binarySASLAuth(req *binaryRequest) *binaryResponse {
+	if req.key != saslMechanisms {
+		return binaryError(req, statusAuthError)
+	}
+
+	credentials := bytes.Split(req.value, []byte{0})
+	if len(credentials) != 3 {
+		return binaryError(req, statusAuthError)
+	}
+	password, ok := m.saslCredentials[string(credentials[1])]
+	if !ok || password != string(credentials[2]) {
+		return binaryError(req, statusAuthError)
+	}
+	return &binaryResponse{opcode: req.opcode, opaque: req.opaque, value: []byte(saslAuthenticated)}
+}
@@ -0,0 +1,546 @@
+package minimemcached
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+func writeBinaryRequest(conn net.Conn, req *binaryRequest) error {
+	header := make([]byte, binaryHeaderSize)
+	header[0] = binaryReqMagic
+	header[1] = req.opcode
+	binary.BigEndian.PutUint16(header[2:4], uint16(len(req.key)))
+	header[4] = byte(len(req.extras))
+	binary.BigEndian.PutUint32(header[8:12], uint32(len(req.extras)+len(req.key)+len(req.value)))
+	binary.BigEndian.PutUint32(header[12:16], req.opaque)
+	binary.BigEndian.PutUint64(header[16:24], req.cas)
+
+	message := append(header, req.extras...)
+	message = append(message, req.key...)
+	message = append(message, req.value...)
+	_, err := conn.Write(message)
+	return err
+}
+
+func readBinaryResponse(conn net.Conn) (*binaryResponse, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		return nil, err
+	}
+	header := make([]byte, binaryHeaderSize)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	if header[0] != binaryResMagic {
+		return nil, fmt.Errorf("invalid magic: %#x", header[0])
+	}
+
+	keyLength := int(binary.BigEndian.Uint16(header[2:4]))
+	extrasLength := int(header[4])
+	body := make([]byte, binary.BigEndian.Uint32(header[8:12]))
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return nil, err
+	}
+	return &binaryResponse{
+		opcode: header[1],
+		status: binary.BigEndian.Uint16(header[6:8]),
+		opaque: binary.BigEndian.Uint32(header[12:16]),
+		cas:    binary.BigEndian.Uint64(header[16:24]),
+		extras: body[:extrasLength],
+		key:    string(body[extrasLength : extrasLength+keyLength]),
+		value:  body[extrasLength+keyLength:],
+	}, nil
+}
+
+func binaryRoundTrip(conn net.Conn, req *binaryRequest) (*binaryResponse, error) {
+	if err := writeBinaryRequest(conn, req); err != nil {
+		return nil, err
+	}
+	res, err := readBinaryResponse(conn)
+	if err != nil {
+		return nil, err
+	}
+	if res.opcode != req.opcode || res.opaque != req.opaque {
+		return nil, fmt.Errorf("opcode/opaque: want %#x/%d, got %#x/%d", req.opcode, req.opaque, res.opcode, res.opaque)
+	}
+	return res, nil
+}
+
+func storageExtras(flags uint32, expiration uint32) []byte {
+	extras := make([]byte, 8)
+	binary.BigEndian.PutUint32(extras[0:4], flags)
+	binary.BigEndian.PutUint32(extras[4:8], expiration)
+	return extras
+}
+
+func deltaExtras(delta uint64, initial uint64, expiration uint32) []byte {
+	extras := make([]byte, 20)
+	binary.BigEndian.PutUint64(extras[0:8], delta)
+	binary.BigEndian.PutUint64(extras[8:16], initial)
+	binary.BigEndian.PutUint32(extras[16:20], expiration)
+	return extras
+}
+
+func expirationExtras(expiration uint32) []byte {
+	extras := make([]byte, 4)
+	binary.BigEndian.PutUint32(extras, expiration)
+	return extras
+}
+
+func TestBinaryGetSet(t *testing.T) {
+	if err := removeAllPreviousData(t); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+
+	conn := dial(t)
+	value := []byte("test\r\nValue")
+	res, err := binaryRoundTrip(conn, &binaryRequest{opcode: opSet, opaque: 1, key: "testKey", extras: storageExtras(7, 60), value: value})
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	if res.status != statusNoError || res.cas != 1 {
+		t.Errorf("set: status %#x, cas %d", res.status, res.cas)
+		return
+	}
+
+	res, err = binaryRoundTrip(conn, &binaryRequest{opcode: opGetK, opaque: 2, key: "testKey"})
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	if res.status != statusNoError || res.key != "testKey" || !bytes.Equal(res.value, value) ||
+		binary.BigEndian.Uint32(res.extras) != 7 || res.cas != 1 {
+		t.Errorf("getk: unexpected response %+v", res)
+		return
+	}
+
+	it, err := mc.Get("testKey")
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	if !bytes.Equal(it.Value, value) {
+		t.Errorf("value: want %q, got %q", value, it.Value)
+		return
+	}
+
+	res, err = binaryRoundTrip(conn, &binaryRequest{opcode: opGet, opaque: 3, key: "wrongKey"})
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	if res.status != statusKeyNotFound || string(res.value) != "Not found" {
+		t.Errorf("get: unexpected response %+v", res)
+		return
+	}
+
+	res, err = binaryRoundTrip(conn, &binaryRequest{opcode: opSet, opaque: 4, key: "testKey", extras: storageExtras(0, 0), value: value, cas: 100})
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	if res.status != statusKeyExists {
+		t.Errorf("set with cas: want status %#x, got %#x", statusKeyExists, res.status)
+		return
+	}
+}
+
+func TestBinaryAddReplaceAppendPrepend(t *testing.T) {
+	if err := removeAllPreviousData(t); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+
+	conn := dial(t)
+	requests := []struct {
+		req    *binaryRequest
+		status uint16
+	}{
+		{&binaryRequest{opcode: opReplace, key: "testKey", extras: storageExtras(0, 0), value: []byte("b")}, statusKeyNotFound},
+		{&binaryRequest{opcode: opAppend, key: "testKey", value: []byte("c")}, statusNotStored},
+		{&binaryRequest{opcode: opAdd, key: "testKey", extras: storageExtras(0, 0), value: []byte("a")}, statusNoError},
+		{&binaryRequest{opcode: opAdd, key: "testKey", extras: storageExtras(0, 0), value: []byte("a")}, statusKeyExists},
+		{&binaryRequest{opcode: opReplace, key: "testKey", extras: storageExtras(0, 0), value: []byte("b")}, statusNoError},
+		{&binaryRequest{opcode: opAppend, key: "testKey", value: []byte("c")}, statusNoError},
+		{&binaryRequest{opcode: opPrepend, key: "testKey", value: []byte("a")}, statusNoError},
+		{&binaryRequest{opcode: opAdd, key: "testKey", value: []byte("a")}, statusInvalidArgs},
+	}
+	for i, r := range requests {
+		r.req.opaque = uint32(i)
+		res, err := binaryRoundTrip(conn, r.req)
+		if err != nil {
+			t.Errorf("err: %v", err)
+			return
+		}
+		if res.status != r.status {
+			t.Errorf("request %d: want status %#x, got %#x", i, r.status, res.status)
+			return
+		}
+	}
+
+	it, err := mc.Get("testKey")
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	if string(it.Value) != "abc" {
+		t.Errorf("value: want %q, got %q", "abc", it.Value)
+		return
+	}
+}
+
+func TestBinaryDeleteIncrDecr(t *testing.T) {
+	if err := removeAllPreviousData(t); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+
+	conn := dial(t)
+	requests := []struct {
+		req    *binaryRequest
+		status uint16
+		value  uint64
+	}{
+		{&binaryRequest{opcode: opIncrement, key: "testKey", extras: deltaExtras(1, 0, binaryNoAutoCreate)}, statusKeyNotFound, 0},
+		{&binaryRequest{opcode: opIncrement, key: "testKey", extras: deltaExtras(1, 10, 0)}, statusNoError, 10},
+		{&binaryRequest{opcode: opIncrement, key: "testKey", extras: deltaExtras(5, 10, 0)}, statusNoError, 15},
+		{&binaryRequest{opcode: opDecrement, key: "testKey", extras: deltaExtras(20, 10, 0)}, statusNoError, 0},
+		{&binaryRequest{opcode: opDelete, key: "testKey"}, statusNoError, 0},
+		{&binaryRequest{opcode: opDelete, key: "testKey"}, statusKeyNotFound, 0},
+		{&binaryRequest{opcode: opSet, key: "testKey", extras: storageExtras(0, 0), value: []byte("a")}, statusNoError, 0},
+		{&binaryRequest{opcode: opIncrement, key: "testKey", extras: deltaExtras(1, 0, 0)}, statusNonNumeric, 0},
+	}
+	for i, r := range requests {
+		r.req.opaque = uint32(i)
+		res, err := binaryRoundTrip(conn, r.req)
+		if err != nil {
+			t.Errorf("err: %v", err)
+			return
+		}
+		if res.status != r.status {
+			t.Errorf("request %d: want status %#x, got %#x", i, r.status, res.status)
+			return
+		}
+		if r.status == statusNoError && (r.req.opcode == opIncrement || r.req.opcode == opDecrement) {
+			if got := binary.BigEndian.Uint64(res.value); got != r.value {
+				t.Errorf("request %d: want value %d, got %d", i, r.value, got)
+				return
+			}
+		}
+	}
+}
+
+func TestBinaryTouchGAT(t *testing.T) {
+	if err := removeAllPreviousData(t); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+
+	if err := mc.Set(&memcache.Item{Key: "testKey", Value: []byte("testValue"), Expiration: 2}); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+
+	conn := dial(t)
+	statsConn := dial(t)
+	before, err := readStats(statsConn, "stats\r\n")
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	res, err := binaryRoundTrip(conn, &binaryRequest{opcode: opTouch, key: "testKey", extras: expirationExtras(60)})
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	if res.status != statusNoError || len(res.value) != 0 {
+		t.Errorf("touch: unexpected response %+v", res)
+		return
+	}
+
+	clk.Add(3 * time.Second)
+	res, err = binaryRoundTrip(conn, &binaryRequest{opcode: opGAT, key: "testKey", extras: expirationExtras(2)})
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	if res.status != statusNoError || string(res.value) != "testValue" {
+		t.Errorf("gat: unexpected response %+v", res)
+		return
+	}
+
+	// Only GAT is counted as a get, and its hit as a touch hit.
+	after, err := readStats(statsConn, "stats\r\n")
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	for name, delta := range map[string]int{"cmd_get": 1, "get_hits": 0, "cmd_touch": 2, "touch_hits": 2} {
+		b, _ := strconv.Atoi(before[name])
+		a, _ := strconv.Atoi(after[name])
+		if a-b != delta {
+			t.Errorf("%s: want: %d, got: %d", name, b+delta, a)
+		}
+	}
+
+	clk.Add(3 * time.Second)
+	if _, err := mc.Get("testKey"); !errors.Is(err, memcache.ErrCacheMiss) {
+		t.Errorf("item must be invalidated. err: %v", err)
+		return
+	}
+}
+
+func TestBinaryMiscellaneous(t *testing.T) {
+	if err := removeAllPreviousData(t); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+
+	if err := mc.Set(&memcache.Item{Key: "testKey", Value: []byte("testValue")}); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+
+	conn := dial(t)
+	res, err := binaryRoundTrip(conn, &binaryRequest{opcode: opVersion})
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	if string(res.value) != Version {
+		t.Errorf("version: want %q, got %q", Version, res.value)
+		return
+	}
+
+	if res, err = binaryRoundTrip(conn, &binaryRequest{opcode: opNoop}); err != nil || res.status != statusNoError {
+		t.Errorf("noop: err %v, response %+v", err, res)
+		return
+	}
+	if res, err = binaryRoundTrip(conn, &binaryRequest{opcode: 0x50}); err != nil || res.status != statusUnknownCmd {
+		t.Errorf("unknown: err %v, response %+v", err, res)
+		return
+	}
+	if res, err = binaryRoundTrip(conn, &binaryRequest{opcode: opFlush}); err != nil || res.status != statusNoError {
+		t.Errorf("flush: err %v, response %+v", err, res)
+		return
+	}
+	if _, err := mc.Get("testKey"); !errors.Is(err, memcache.ErrCacheMiss) {
+		t.Errorf("item must be flushed. err: %v", err)
+		return
+	}
+
+	if err := writeBinaryRequest(conn, &binaryRequest{opcode: opStat}); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	stats := map[string]string{}
+	for {
+		res, err := readBinaryResponse(conn)
+		if err != nil {
+			t.Errorf("err: %v", err)
+			return
+		}
+		if res.key == "" {
+			break
+		}
+		stats[res.key] = string(res.value)
+	}
+	if stats["version"] != Version || stats["curr_items"] != "0" {
+		t.Errorf("stat: unexpected stats %v", stats)
+		return
+	}
+
+	if res, err = binaryRoundTrip(conn, &binaryRequest{opcode: opQuit}); err != nil || res.status != statusNoError {
+		t.Errorf("quit: err %v, response %+v", err, res)
+		return
+	}
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Errorf("connection must be closed. err: %v", err)
+		return
+	}
+}
+
+func TestBinaryQuietMultiGet(t *testing.T) {
+	if err := removeAllPreviousData(t); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+
+	conn := dial(t)
+	requests := []*binaryRequest{
+		{opcode: opSetQ, opaque: 1, key: "key1", extras: storageExtras(0, 0), value: []byte("value1")},
+		{opcode: opSetQ, opaque: 2, key: "key2", extras: storageExtras(0, 0), value: []byte("value2")},
+		{opcode: opAddQ, opaque: 3, key: "key1", extras: storageExtras(0, 0), value: []byte("value3")},
+		{opcode: opIncrementQ, opaque: 4, key: "key3", extras: deltaExtras(1, 5, 0)},
+		{opcode: opDeleteQ, opaque: 5, key: "key4"},
+		{opcode: opGetKQ, opaque: 6, key: "key1"},
+		{opcode: opGetKQ, opaque: 7, key: "key4"},
+		{opcode: opGetQ, opaque: 8, key: "key3"},
+		{opcode: opGetKQ, opaque: 9, key: "key2"},
+		{opcode: opNoop, opaque: 10},
+	}
+	for _, req := range requests {
+		if err := writeBinaryRequest(conn, req); err != nil {
+			t.Errorf("err: %v", err)
+			return
+		}
+	}
+
+	want := []struct {
+		opcode byte
+		opaque uint32
+		status uint16
+		key    string
+		value  string
+	}{
+		{opAddQ, 3, statusKeyExists, "", "Data exists for key."},
+		{opDeleteQ, 5, statusKeyNotFound, "", "Not found"},
+		{opGetKQ, 6, statusNoError, "key1", "value1"},
+		{opGetQ, 8, statusNoError, "", "5"},
+		{opGetKQ, 9, statusNoError, "key2", "value2"},
+		{opNoop, 10, statusNoError, "", ""},
+	}
+	for _, w := range want {
+		res, err := readBinaryResponse(conn)
+		if err != nil {
+			t.Errorf("err: %v", err)
+			return
+		}
+		if res.opcode != w.opcode || res.opaque != w.opaque || res.status != w.status || res.key != w.key || string(res.value) != w.value {
+			t.Errorf("want %+v, got %+v", w, res)
+			return
+		}
+	}
+}
+
+func TestBinaryQuitQ(t *testing.T) {
+	if err := removeAllPreviousData(t); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+
+	conn := dial(t)
+	if err := writeBinaryRequest(conn, &binaryRequest{opcode: opQuitQ}); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Errorf("connection must be closed without a response. err: %v", err)
+		return
+	}
+}
+
+func TestBinaryTooLarge(t *testing.T) {
+	m, err := Run(&Config{MaxItemSize: 100}, WithClock(clk))
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	defer m.Close()
+
+	conn, err := net.Dial("tcp", fmt.Sprintf(":%d", m.Port()))
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	// Values are discarded without being buffered, and a Set too large for the cache removes the previous value.
+	tooLarge := bytes.Repeat([]byte("a"), 101)
+	requests := []struct {
+		req    *binaryRequest
+		status uint16
+		value  string
+	}{
+		{&binaryRequest{opcode: opSet, key: "testKey", extras: storageExtras(0, 0), value: []byte("old")}, statusNoError, ""},
+		{&binaryRequest{opcode: opAdd, key: "testKey", extras: storageExtras(0, 0), value: tooLarge}, statusTooLarge, "Too large."},
+		{&binaryRequest{opcode: opGet, key: "testKey"}, statusNoError, "old"},
+		{&binaryRequest{opcode: opSet, key: "testKey", extras: storageExtras(0, 0), value: tooLarge}, statusTooLarge, "Too large."},
+		{&binaryRequest{opcode: opGet, key: "testKey"}, statusKeyNotFound, "Not found"},
+		{&binaryRequest{opcode: opNoop}, statusNoError, ""},
+	}
+	for i, r := range requests {
+		r.req.opaque = uint32(i)
+		res, err := binaryRoundTrip(conn, r.req)
+		if err != nil {
+			t.Errorf("err: %v", err)
+			return
+		}
+		if res.status != r.status || string(res.value) != r.value {
+			t.Errorf("request %d: want %#x %q, got %#x %q", i, r.status, r.value, res.status, res.value)
+			return
+		}
+	}
+}
+
+func TestBinarySASLAuth(t *testing.T) {
+	m, err := Run(&Config{SASLCredentials: map[string]string{"user": "password"}}, WithClock(clk))
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	defer m.Close()
+
+	conn, err := net.Dial("tcp", fmt.Sprintf(":%d", m.Port()))
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	requests := []struct {
+		req    *binaryRequest
+		status uint16
+		value  string
+	}{
+		{&binaryRequest{opcode: opGet, key: "testKey"}, statusAuthError, "Auth failure."},
+		{&binaryRequest{opcode: opSASLListMechs}, statusNoError, "PLAIN"},
+		{&binaryRequest{opcode: opSASLAuth, key: "PLAIN", value: []byte("\x00user\x00wrong")}, statusAuthError, "Auth failure."},
+		{&binaryRequest{opcode: opSASLAuth, key: "CRAM-MD5", value: []byte("\x00user\x00password")}, statusAuthError, "Auth failure."},
+		{&binaryRequest{opcode: opSetQ, key: "testKey", extras: storageExtras(0, 0), value: []byte("a")}, statusAuthError, "Auth failure."},
+		{&binaryRequest{opcode: opSASLAuth, key: "PLAIN", value: []byte("\x00user\x00password")}, statusNoError, "Authenticated"},
+		{&binaryRequest{opcode: opSet, key: "testKey", extras: storageExtras(0, 0), value: []byte("a")}, statusNoError, ""},
+		{&binaryRequest{opcode: opGet, key: "testKey"}, statusNoError, "a"},
+	}
+	for i, r := range requests {
+		r.req.opaque = uint32(i)
+		res, err := binaryRoundTrip(conn, r.req)
+		if err != nil {
+			t.Errorf("err: %v", err)
+			return
+		}
+		if res.status != r.status || string(res.value) != r.value {
+			t.Errorf("request %d: want %#x %q, got %#x %q", i, r.status, r.value, res.status, res.value)
+			return
+		}
+	}
+
+	asciiConn, err := net.Dial("tcp", fmt.Sprintf(":%d", m.Port()))
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	defer asciiConn.Close()
+	if err := request(asciiConn, "version\r\n", ""); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	if _, err := asciiConn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Errorf("ascii connection must be closed. err: %v", err)
+		return
+	}
+}
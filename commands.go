@@ -2,321 +2,972 @@ package minimemcached
 
 import (
 	"fmt"
-	"math/big"
-	"net"
+	"io"
+	"math"
+	"sort"
 	"strconv"
+	"sync/atomic"
+	"time"
 )
 
-// gets() handles memcached `gets` command.
-func (m *MiniMemcached) gets(keys []string, conn net.Conn) {
+// fetch() returns a copy of the item under key, and records the access to it.
+func (m *MiniMemcached) fetch(key string) (item, bool) {
+	return m.fetchItem(key, false, 0)
+}
+
+// fetchAndTouch() updates exptime of the item under key as fetch() returns it, as `gat` does.
+func (m *MiniMemcached) fetchAndTouch(key string, exptime int64) (item, bool) {
+	return m.fetchItem(key, true, exptime)
+}
+
+// fetchItem() returns a copy of the item under key, and records the access to it. When touch is true,
+// it also updates exptime of the item, and counts its hit or miss as a touch instead of a get, as memcached does.
+func (m *MiniMemcached) fetchItem(key string, touch bool, exptime int64) (item, bool) {
+	expired := m.invalidate(key)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counters.cmdGet++
+	if touch {
+		m.counters.cmdTouch++
+	}
+	prefixStats := m.prefixStatsOf(key)
+	if prefixStats != nil {
+		prefixStats.Gets++
+	}
+	it := m.items[key]
+	if it == nil {
+		if expired {
+			m.counters.getExpired++
+		}
+		if touch {
+			m.counters.touchMisses++
+		} else {
+			m.counters.getMisses++
+		}
+		return item{}, false
+	}
+	if touch {
+		m.counters.touchHits++
+	} else {
+		m.counters.getHits++
+	}
+	if prefixStats != nil {
+		prefixStats.Hits++
+	}
+	now := m.clock.Now().Unix()
+	it.access(now)
+	m.bump(it)
+	if touch {
+		it.expiresAt = deadline(exptime, now)
+	}
+	return *it, true
+}
+
+// peek() returns a copy of the item under key, without counting a get nor recording an access.
+func (m *MiniMemcached) peek(key string) (item, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	it := m.items[key]
+	if it == nil {
+		return item{}, false
+	}
+	return *it, true
+}
+
+// gets() handles memcached `get` and `gets` command.
+// CAS tokens are written to the VALUE lines only when withCAS is true.
+func (m *MiniMemcached) gets(keys []string, withCAS bool, w io.Writer) {
+	m.writeValues(keys, withCAS, m.fetch, w)
+}
+
+// writeValues() writes the VALUE lines of the items under keys, which are retrieved with fetch.
+func (m *MiniMemcached) writeValues(keys []string, withCAS bool, fetch func(string) (item, bool), w io.Writer) {
 	for _, k := range keys {
 		if !isLegalKey(k) {
-			_, _ = conn.Write(resultClientErrBadCliFormat)
+			_, _ = w.Write(resultClientErrBadCliFormat)
 			return
 		}
 	}
 	result := make([]byte, 0)
 	for _, k := range keys {
-		m.invalidate(k)
-		m.mu.RLock()
-		item := m.items[k]
-		m.mu.RUnlock()
-		if item != nil {
-			result = append(result, []byte(fmt.Sprintf("%s %s %d %d %d\r\n", value, k, item.flags, len(item.value), item.casToken))...)
+		if item, ok := fetch(k); ok {
+			if withCAS {
+				result = append(result, []byte(fmt.Sprintf("%s %s %d %d %d\r\n", value, k, item.flags, len(item.value), item.casToken))...)
+			} else {
+				result = append(result, []byte(fmt.Sprintf("%s %s %d %d\r\n", value, k, item.flags, len(item.value)))...)
+			}
 			result = append(result, item.value...)
 			result = append(result, crlf...)
 		}
 	}
 	result = append(result, resultEnd...)
-	_, _ = conn.Write(result)
+	_, _ = w.Write(result)
 }
 
-// set() handles memcached `set` command.
-func (m *MiniMemcached) set(key string, item *item, bytes int, conn net.Conn) {
+// gat() handles memcached `gat` and `gats` command.
+// It updates exptime of every existing item and returns them as gets() does.
+func (m *MiniMemcached) gat(exptime int64, keys []string, withCAS bool, w io.Writer) {
+	m.writeValues(keys, withCAS, func(key string) (item, bool) {
+		return m.fetchAndTouch(key, exptime)
+	}, w)
+}
+
+// metaGet() handles memcached `mg` command.
+func (m *MiniMemcached) metaGet(key string, flags metaFlags, w io.Writer) {
 	if !isLegalKey(key) {
-		_, _ = conn.Write(resultClientErrBadCliFormat)
+		_, _ = w.Write(resultClientErrBadCliFormat)
 		return
 	}
-	if !isLegalValue(bytes, item.value) {
-		_, _ = conn.Write(resultClientErrBadDataChunk)
-		return
+
+	expired := m.invalidate(key)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counters.cmdGet++
+	prefixStats := m.prefixStatsOf(key)
+	if prefixStats != nil {
+		prefixStats.Gets++
+	}
+	now := m.clock.Now().Unix()
+	it := m.items[key]
+	won := false
+	if it == nil {
+		if expired {
+			m.counters.getExpired++
+		}
+		m.counters.getMisses++
+		vivifyTTL, vivify := flags.numericToken('N')
+		vivified := &item{
+			value:          []byte{},
+			expiresAt:      deadline(vivifyTTL, now),
+			lastAccessedAt: now,
+		}
+		if !vivify || !m.reserve(vivified.size(key)) {
+			if flags.has('q') {
+				return
+			}
+			result := appendMetaEcho([]byte(metaMiss), key, flags)
+			_, _ = w.Write(append(result, crlf...))
+			return
+		}
+		it = vivified
+		it.casToken = m.incrementCASToken()
+		m.link(key, it)
+		m.counters.totalItems++
+		won = true
+	} else {
+		m.counters.getHits++
+		if prefixStats != nil {
+			prefixStats.Hits++
+		}
+		if recacheTTL, recache := flags.numericToken('R'); recache && !it.winTokenSent {
+			if expiresAt := it.expiresAt; expiresAt != 0 && expiresAt-now < recacheTTL {
+				won = true
+			}
+		}
+	}
+
+	if ttl, ok := flags.numericToken('T'); ok {
+		it.expiresAt = deadline(ttl, now)
+	}
+
+	var result []byte
+	if flags.has('v') {
+		result = []byte(fmt.Sprintf("%s %d", metaValue, len(it.value)))
+	} else {
+		result = []byte(metaHit)
+	}
+	for _, f := range flags {
+		switch f.flag {
+		case 'c':
+			result = appendMetaFlag(result, 'c', strconv.FormatUint(it.casToken, 10))
+		case 'f':
+			result = appendMetaFlag(result, 'f', strconv.FormatUint(uint64(it.flags), 10))
+		case 'h':
+			if it.fetched {
+				result = appendMetaFlag(result, 'h', "1")
+			} else {
+				result = appendMetaFlag(result, 'h', "0")
+			}
+		case 'k':
+			result = appendMetaFlag(result, 'k', key)
+		case 'l':
+			result = appendMetaFlag(result, 'l', strconv.FormatInt(now-it.lastAccessedAt, 10))
+		case 'O':
+			result = appendMetaFlag(result, 'O', f.token)
+		case 's':
+			result = appendMetaFlag(result, 's', strconv.Itoa(len(it.value)))
+		case 't':
+			ttl := int64(-1)
+			if expiresAt := it.expiresAt; expiresAt != 0 {
+				ttl = expiresAt - now
+			}
+			result = appendMetaFlag(result, 't', strconv.FormatInt(ttl, 10))
+		}
+	}
+	// A client which has won is not told that a win token has been sent,
+	// so that only the other clients see Z until the item is recached.
+	if it.winTokenSent {
+		result = appendMetaFlag(result, 'Z', "")
+	}
+	if it.stale {
+		result = appendMetaFlag(result, 'X', "")
+		if !it.winTokenSent {
+			won = true
+		}
+	}
+	if won {
+		result = appendMetaFlag(result, 'W', "")
+		it.winTokenSent = true
+	}
+	result = append(result, crlf...)
+	if flags.has('v') {
+		result = append(result, it.value...)
+		result = append(result, crlf...)
 	}
 
+	if !flags.has('u') {
+		it.access(now)
+		m.bump(it)
+	}
+	_, _ = w.Write(result)
+}
+
+// store() stores item under key by mode, and returns the result.
+// casToken must match the CAS token of the stored item for modeCAS. For the other modes, it is
+// only compared when it is not 0. If invalidate is set and casToken is older than the stored
+// item's, item is stored as stale instead of failing. A CAS token already set on item is kept.
+func (m *MiniMemcached) store(mode storeMode, key string, item *item, casToken uint64, invalidate bool) storeResult {
 	m.invalidate(key)
 
 	m.mu.Lock()
-	item.casToken = m.incrementCASToken()
-	m.items[key] = item
-	m.mu.Unlock()
-	_, _ = conn.Write(resultStored)
+	defer m.mu.Unlock()
+	m.counters.cmdSet++
+	if prefixStats := m.prefixStatsOf(key); prefixStats != nil {
+		prefixStats.Sets++
+	}
+	prevItem := m.items[key]
+	if item.size(key) > m.maxItemSize {
+		if mode == modeSet {
+			m.unlinkTooLarge(key)
+		}
+		return storeTooLarge
+	}
+	switch mode {
+	case modeAdd:
+		if prevItem != nil {
+			return storeNotStored
+		}
+	case modeReplace, modeAppend, modePrepend:
+		if prevItem == nil {
+			return storeNotStored
+		}
+	case modeCAS:
+		if prevItem == nil {
+			m.counters.casMisses++
+			return storeNotFound
+		}
+	}
+
+	compare := prevItem != nil && (mode == modeCAS || casToken != 0)
+	if compare && prevItem.casToken != casToken {
+		if !invalidate || casToken > prevItem.casToken {
+			m.counters.casBadval++
+			return storeExists
+		}
+		item.expiresAt = prevItem.expiresAt
+		item.stale = true
+		item.winTokenSent = prevItem.winTokenSent
+	}
+
+	newItem := item
+	switch mode {
+	case modeAppend:
+		appended := *prevItem
+		appended.value = append(append([]byte{}, prevItem.value...), item.value...)
+		newItem = &appended
+	case modePrepend:
+		prepended := *prevItem
+		prepended.value = append(append([]byte{}, item.value...), prevItem.value...)
+		newItem = &prepended
+	}
+	if newItem.size(key) > m.maxItemSize {
+		return storeTooLarge
+	}
+	// The previous item is unlinked to make room for the new one. As in memcached, an item which
+	// cannot be replaced is not left behind, while an item which cannot be appended to is kept.
+	if prevItem != nil {
+		m.unlink(key)
+	}
+	if !m.reserve(newItem.size(key)) {
+		if mode == modeAppend || mode == modePrepend {
+			m.link(key, prevItem)
+		}
+		return storeOutOfMemory
+	}
+
+	if item.casToken == 0 {
+		item.casToken = m.incrementCASToken()
+	}
+	newItem.casToken = item.casToken
+	m.link(key, newItem)
+	if compare {
+		m.counters.casHits++
+	}
+	m.counters.totalItems++
+	return storeStored
 }
 
-// add() handles memcached `add` command.
-func (m *MiniMemcached) add(key string, item *item, bytes int, conn net.Conn) {
+// unlinkTooLarge() removes the item under key when a `set` of a value too large for the cache fails,
+// as memcached does, so that the client does not read the previous value.
+// The caller must hold the mutex of MiniMemcached.
+func (m *MiniMemcached) unlinkTooLarge(key string) {
+	if m.items[key] != nil {
+		m.unlink(key)
+	}
+}
+
+// metaSet() handles memcached `ms` command.
+func (m *MiniMemcached) metaSet(key string, mode storeMode, flags metaFlags, bytes int, value []byte, w io.Writer) {
 	if !isLegalKey(key) {
-		_, _ = conn.Write(resultClientErrBadCliFormat)
+		_, _ = w.Write(resultClientErrBadCliFormat)
 		return
 	}
-	if !isLegalValue(bytes, item.value) {
-		_, _ = conn.Write(resultClientErrBadDataChunk)
+	if !isLegalValue(bytes, value) {
+		_, _ = w.Write(resultClientErrBadDataChunk)
+		return
+	}
+
+	now := m.clock.Now().Unix()
+	it := &item{
+		value:          value,
+		lastAccessedAt: now,
+	}
+	if clientFlags, ok := flags.numericToken('F'); ok {
+		it.flags = uint32(clientFlags)
+	}
+	if ttl, ok := flags.numericToken('T'); ok {
+		it.expiresAt = deadline(ttl, now)
+	}
+	if casToken, ok := flags.unsignedToken('E'); ok {
+		it.casToken = casToken
+	}
+	casToken, compare := flags.unsignedToken('C')
+	if compare && mode == modeSet {
+		mode = modeCAS
+	}
+
+	res := m.store(mode, key, it, casToken, flags.has('I'))
+	if res == storeStored && flags.has('q') {
+		return
+	}
+	if res == storeOutOfMemory || res == storeTooLarge {
+		_, _ = w.Write(storeResults[res])
+		return
+	}
+
+	result := []byte(metaStoreResults[res])
+	for _, f := range flags {
+		switch f.flag {
+		case 'c':
+			if res == storeStored {
+				result = appendMetaFlag(result, 'c', strconv.FormatUint(it.casToken, 10))
+			}
+		case 'k':
+			result = appendMetaFlag(result, 'k', key)
+		case 'O':
+			result = appendMetaFlag(result, 'O', f.token)
+		}
+	}
+	_, _ = w.Write(append(result, crlf...))
+}
+
+// metaNoOp() handles memcached `mn` command.
+func (m *MiniMemcached) metaNoOp(w io.Writer) {
+	_, _ = w.Write(resultMetaNoOp)
+}
+
+// metaDebug() handles memcached `me` command.
+func (m *MiniMemcached) metaDebug(key string, w io.Writer) {
+	if !isLegalKey(key) {
+		_, _ = w.Write(resultClientErrBadCliFormat)
 		return
 	}
 
 	m.invalidate(key)
 
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	if prevItem := m.items[key]; prevItem != nil {
-		_, _ = conn.Write(resultNotStored)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	item := m.items[key]
+	if item == nil {
+		_, _ = w.Write(append([]byte(metaMiss), crlf...))
 		return
 	}
 
-	item.casToken = m.incrementCASToken()
-	m.items[key] = item
-	_, _ = conn.Write(resultStored)
+	now := m.clock.Now().Unix()
+	exp := int64(-1)
+	if expiresAt := item.expiresAt; expiresAt != 0 {
+		exp = expiresAt - now
+	}
+	fetch := "no"
+	if item.fetched {
+		fetch = "yes"
+	}
+	size := item.size(key)
+	_, _ = w.Write([]byte(fmt.Sprintf("%s %s exp=%d la=%d cas=%d fetch=%s cls=%d size=%d\r\n",
+		metaDebug, key, exp, now-item.lastAccessedAt, item.casToken, fetch, m.slabClassID(size), size)))
 }
 
-// replace() handles memcached `replace` command.
-func (m *MiniMemcached) replace(key string, item *item, bytes int, conn net.Conn) {
+// set() handles memcached `set` command.
+func (m *MiniMemcached) set(key string, item *item, bytes int, w io.Writer) {
 	if !isLegalKey(key) {
-		_, _ = conn.Write(resultClientErrBadCliFormat)
+		_, _ = w.Write(resultClientErrBadCliFormat)
 		return
 	}
 	if !isLegalValue(bytes, item.value) {
-		_, _ = conn.Write(resultClientErrBadDataChunk)
+		_, _ = w.Write(resultClientErrBadDataChunk)
 		return
 	}
 
-	m.invalidate(key)
+	_, _ = w.Write(storeResults[m.store(modeSet, key, item, 0, false)])
+}
 
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	if prevItem := m.items[key]; prevItem == nil {
-		_, _ = conn.Write(resultNotStored)
+// add() handles memcached `add` command.
+func (m *MiniMemcached) add(key string, item *item, bytes int, w io.Writer) {
+	if !isLegalKey(key) {
+		_, _ = w.Write(resultClientErrBadCliFormat)
+		return
+	}
+	if !isLegalValue(bytes, item.value) {
+		_, _ = w.Write(resultClientErrBadDataChunk)
 		return
 	}
 
-	item.casToken = m.incrementCASToken()
-	m.items[key] = item
-	_, _ = conn.Write(resultStored)
+	_, _ = w.Write(storeResults[m.store(modeAdd, key, item, 0, false)])
 }
 
-// append() handles memcached `append` command.
-func (m *MiniMemcached) append(key string, bytes int, value []byte, conn net.Conn) {
+// replace() handles memcached `replace` command.
+func (m *MiniMemcached) replace(key string, item *item, bytes int, w io.Writer) {
 	if !isLegalKey(key) {
-		_, _ = conn.Write(resultErr)
+		_, _ = w.Write(resultClientErrBadCliFormat)
 		return
 	}
-	if !isLegalValue(bytes, value) {
-		_, _ = conn.Write(resultClientErrBadDataChunk)
+	if !isLegalValue(bytes, item.value) {
+		_, _ = w.Write(resultClientErrBadDataChunk)
 		return
 	}
 
-	m.invalidate(key)
+	_, _ = w.Write(storeResults[m.store(modeReplace, key, item, 0, false)])
+}
 
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	prevItem := m.items[key]
-	if prevItem == nil {
-		_, _ = conn.Write(resultNotStored)
+// append() handles memcached `append` command.
+func (m *MiniMemcached) append(key string, bytes int, value []byte, w io.Writer) {
+	if !isLegalKey(key) {
+		_, _ = w.Write(resultErr)
+		return
+	}
+	if !isLegalValue(bytes, value) {
+		_, _ = w.Write(resultClientErrBadDataChunk)
 		return
 	}
 
-	prevItem.casToken = m.incrementCASToken()
-	prevItem.value = append(prevItem.value, value...)
-	_, _ = conn.Write(resultStored)
+	_, _ = w.Write(storeResults[m.store(modeAppend, key, &item{value: value}, 0, false)])
 }
 
 // prepend() handles memcached `prepend` command.
-func (m *MiniMemcached) prepend(key string, bytes int, value []byte, conn net.Conn) {
+func (m *MiniMemcached) prepend(key string, bytes int, value []byte, w io.Writer) {
 	if !isLegalKey(key) {
-		_, _ = conn.Write(resultClientErrBadCliFormat)
+		_, _ = w.Write(resultClientErrBadCliFormat)
 		return
 	}
 	if !isLegalValue(bytes, value) {
-		_, _ = conn.Write(resultClientErrBadDataChunk)
+		_, _ = w.Write(resultClientErrBadDataChunk)
 		return
 	}
 
+	_, _ = w.Write(storeResults[m.store(modePrepend, key, &item{value: value}, 0, false)])
+}
+
+// remove() removes the item under key, and returns the result.
+// casToken is compared with the CAS token of the stored item when it is not 0.
+// If stale is set, the item is marked as stale and given a new CAS token instead of being removed.
+func (m *MiniMemcached) remove(key string, casToken uint64, stale bool) storeResult {
 	m.invalidate(key)
 
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	prevItem := m.items[key]
-	if prevItem == nil {
-		_, _ = conn.Write(resultNotStored)
-		return
+	if prefixStats := m.prefixStatsOf(key); prefixStats != nil {
+		prefixStats.Deletes++
+	}
+	item := m.items[key]
+	if item == nil {
+		m.counters.deleteMisses++
+		return storeNotFound
+	}
+	if casToken != 0 && item.casToken != casToken {
+		return storeExists
 	}
 
-	prevItem.casToken = m.incrementCASToken()
-	prevItem.value = append(value, prevItem.value...)
-	_, _ = conn.Write(resultStored)
+	m.counters.deleteHits++
+	if stale {
+		item.stale = true
+		item.winTokenSent = false
+		item.casToken = m.incrementCASToken()
+		return storeStored
+	}
+	m.unlink(key)
+	return storeStored
 }
 
 // delete() handles memcached `delete` command.
-func (m *MiniMemcached) delete(key string, conn net.Conn) {
+func (m *MiniMemcached) delete(key string, w io.Writer) {
 	if !isLegalKey(key) {
-		_, _ = conn.Write(resultClientErrBadCliFormat)
+		_, _ = w.Write(resultClientErrBadCliFormat)
 		return
 	}
 
-	m.invalidate(key)
-
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	if item := m.items[key]; item == nil {
-		_, _ = conn.Write(resultNotFound)
+	if res := m.remove(key, 0, false); res == storeNotFound {
+		_, _ = w.Write(resultNotFound)
 		return
 	}
-	delete(m.items, key)
-	_, _ = conn.Write(resultDeleted)
+	_, _ = w.Write(resultDeleted)
 }
 
-// incr() handles memcached `incr` command.
-func (m *MiniMemcached) incr(key string, incrValue uint64, conn net.Conn) {
-	if !isLegalKey(key) {
-		_, _ = conn.Write(resultClientErrBadCliFormat)
-		return
-	}
-
+// applyDelta() increments or decrements the numeric value of the item under key by delta,
+// and returns a copy of the updated item along with the result.
+// Like memcached, incrementing wraps around at 64 bits and decrementing stops at 0.
+// casToken is compared with the CAS token of the stored item when it is not 0.
+func (m *MiniMemcached) applyDelta(key string, incr bool, delta uint64, casToken uint64) (item, storeResult) {
 	m.invalidate(key)
 
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	item := m.items[key]
-	if item == nil {
-		_, _ = conn.Write(resultNotFound)
-		return
+	it := m.items[key]
+	if it == nil {
+		if incr {
+			m.counters.incrMisses++
+		} else {
+			m.counters.decrMisses++
+		}
+		return item{}, storeNotFound
+	}
+	if casToken != 0 && it.casToken != casToken {
+		return item{}, storeExists
 	}
 
-	numericItemValue, isNumeric := getNumericValueFromByteArray(item.value)
+	numericItemValue, isNumeric := getNumericValueFromByteArray(it.value)
 	if !isNumeric {
-		_, _ = conn.Write(resultClientErrIncrDecrNonNumericValue)
-		return
+		return item{}, storeNonNumeric
 	}
 
-	item.casToken = m.incrementCASToken()
-
-	var (
-		numericItemValueInt big.Int
-		numericIncrValueInt big.Int
-		incrementedValueInt big.Int
-
-		incrementedValue uint64
-	)
+	var newValue uint64
+	if incr {
+		m.counters.incrHits++
+		newValue = numericItemValue + delta
+	} else {
+		m.counters.decrHits++
+		if numericItemValue > delta {
+			newValue = numericItemValue - delta
+		}
+	}
 
-	numericItemValueInt.SetUint64(numericItemValue)
-	numericIncrValueInt.SetUint64(incrValue)
-	incrementedValueInt.Add(&numericItemValueInt, &numericIncrValueInt)
+	it.casToken = m.incrementCASToken()
+	m.setValue(key, it, []byte(strconv.FormatUint(newValue, 10)))
+	return *it, storeStored
+}
 
-	if incrementedValueInt.IsUint64() {
-		incrementedValue = numericItemValue + incrValue
-	} else {
-		incrementedValue = 0
+// incr() handles memcached `incr` command.
+func (m *MiniMemcached) incr(key string, incrValue uint64, w io.Writer) {
+	if !isLegalKey(key) {
+		_, _ = w.Write(resultClientErrBadCliFormat)
+		return
 	}
 
-	value := []byte(strconv.FormatUint(incrementedValue, 10))
-	item.value = value
-	result := append(value, crlf...)
-	_, _ = conn.Write(result)
+	item, res := m.applyDelta(key, true, incrValue, 0)
+	switch res {
+	case storeNotFound:
+		_, _ = w.Write(resultNotFound)
+	case storeNonNumeric:
+		_, _ = w.Write(resultClientErrIncrDecrNonNumericValue)
+	default:
+		_, _ = w.Write(append(item.value, crlf...))
+	}
 }
 
 // decr() handles memcached `decr` command.
-func (m *MiniMemcached) decr(key string, decrValue uint64, conn net.Conn) {
+func (m *MiniMemcached) decr(key string, decrValue uint64, w io.Writer) {
 	if !isLegalKey(key) {
-		_, _ = conn.Write(resultClientErrBadCliFormat)
+		_, _ = w.Write(resultClientErrBadCliFormat)
 		return
 	}
 
+	item, res := m.applyDelta(key, false, decrValue, 0)
+	switch res {
+	case storeNotFound:
+		_, _ = w.Write(resultNotFound)
+	case storeNonNumeric:
+		_, _ = w.Write(resultClientErrIncrDecrNonNumericValue)
+	default:
+		_, _ = w.Write(append(item.value, crlf...))
+	}
+}
+
+// touchItem() updates exptime of the item under key, so that it expires exptime from now, and returns the result.
+func (m *MiniMemcached) touchItem(key string, exptime int64) storeResult {
 	m.invalidate(key)
 
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	m.counters.cmdTouch++
+	if !m.updateExptime(key, exptime) {
+		m.counters.touchMisses++
+		return storeNotFound
+	}
+	m.counters.touchHits++
+	return storeStored
+}
+
+// updateExptime() updates exptime of the item under key without counting a touch,
+// and reports whether the item exists. The caller must hold the mutex of MiniMemcached.
+func (m *MiniMemcached) updateExptime(key string, exptime int64) bool {
 	item := m.items[key]
 	if item == nil {
-		_, _ = conn.Write(resultNotFound)
+		return false
+	}
+	m.bump(item)
+	item.expiresAt = deadline(exptime, m.clock.Now().Unix())
+	return true
+}
+
+// touch() handles memcached `touch` command.
+func (m *MiniMemcached) touch(key string, exptime int64, w io.Writer) {
+	if !isLegalKey(key) {
+		_, _ = w.Write(resultClientErrBadCliFormat)
 		return
 	}
-	numericItemValue, isNumeric := getNumericValueFromByteArray(item.value)
-	if !isNumeric {
-		_, _ = conn.Write(resultClientErrIncrDecrNonNumericValue)
+
+	if res := m.touchItem(key, exptime); res == storeNotFound {
+		_, _ = w.Write(resultNotFound)
 		return
 	}
+	_, _ = w.Write(resultTouched)
+}
 
-	item.casToken = m.incrementCASToken()
+// metaDelete() handles memcached `md` command.
+func (m *MiniMemcached) metaDelete(key string, flags metaFlags, w io.Writer) {
+	if !isLegalKey(key) {
+		_, _ = w.Write(resultClientErrBadCliFormat)
+		return
+	}
 
-	var decrementedValue uint64
-	if numericItemValue < decrValue {
-		decrementedValue = 0
-	} else {
-		decrementedValue = numericItemValue - decrValue
+	casToken, _ := flags.unsignedToken('C')
+	stale := flags.has('I')
+	res := m.remove(key, casToken, stale)
+	if ttl, ok := flags.numericToken('T'); ok && stale && res == storeStored {
+		m.mu.Lock()
+		m.updateExptime(key, ttl)
+		m.mu.Unlock()
+	}
+	if (res == storeStored || res == storeNotFound) && flags.has('q') {
+		return
 	}
-	value := []byte(strconv.FormatUint(decrementedValue, 10))
-	item.value = value
-	result := append(value, crlf...)
-	_, _ = conn.Write(result)
+
+	result := appendMetaEcho([]byte(metaStoreResults[res]), key, flags)
+	_, _ = w.Write(append(result, crlf...))
 }
 
-// touch() handles memcached `touch` command.
-func (m *MiniMemcached) touch(key string, expiration int32, conn net.Conn) {
+// metaArithmetic() handles memcached `ma` command.
+func (m *MiniMemcached) metaArithmetic(key string, incr bool, flags metaFlags, w io.Writer) {
 	if !isLegalKey(key) {
-		_, _ = conn.Write(resultClientErrBadCliFormat)
+		_, _ = w.Write(resultClientErrBadCliFormat)
 		return
 	}
 
-	m.invalidate(key)
+	delta := uint64(1)
+	if d, ok := flags.unsignedToken('D'); ok {
+		delta = d
+	}
+	casToken, _ := flags.unsignedToken('C')
 
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	item := m.items[key]
-	if item == nil {
-		_, _ = conn.Write(resultNotFound)
+	it, res := m.applyDelta(key, incr, delta, casToken)
+	if vivifyTTL, vivify := flags.numericToken('N'); vivify && res == storeNotFound {
+		initial, _ := flags.unsignedToken('J')
+		now := m.clock.Now().Unix()
+		vivified := &item{
+			value:          []byte(strconv.FormatUint(initial, 10)),
+			expiresAt:      deadline(vivifyTTL, now),
+			lastAccessedAt: now,
+		}
+		if res = m.store(modeAdd, key, vivified, 0, false); res == storeStored {
+			it = *vivified
+		}
+	}
+	if ttl, ok := flags.numericToken('T'); ok && res == storeStored {
+		m.mu.Lock()
+		m.updateExptime(key, ttl)
+		m.mu.Unlock()
+		it.expiresAt = deadline(ttl, m.clock.Now().Unix())
+	}
+
+	switch res {
+	case storeNonNumeric:
+		_, _ = w.Write(resultClientErrIncrDecrNonNumericValue)
 		return
+	case storeOutOfMemory:
+		_, _ = w.Write(resultServerErrOutOfMemory)
+		return
+	case storeNotFound:
+		if flags.has('q') {
+			return
+		}
+	case storeStored:
+		if flags.has('q') && !flags.has('v') {
+			return
+		}
 	}
-	item.expiration = expiration
-	_, _ = conn.Write(resultTouched)
+
+	var result []byte
+	if res == storeStored && flags.has('v') {
+		result = []byte(fmt.Sprintf("%s %d", metaValue, len(it.value)))
+	} else {
+		result = []byte(metaStoreResults[res])
+	}
+	for _, f := range flags {
+		switch f.flag {
+		case 'c':
+			if res == storeStored {
+				result = appendMetaFlag(result, 'c', strconv.FormatUint(it.casToken, 10))
+			}
+		case 't':
+			if res == storeStored {
+				ttl := int64(-1)
+				if expiresAt := it.expiresAt; expiresAt != 0 {
+					ttl = expiresAt - m.clock.Now().Unix()
+				}
+				result = appendMetaFlag(result, 't', strconv.FormatInt(ttl, 10))
+			}
+		case 'k':
+			result = appendMetaFlag(result, 'k', key)
+		case 'O':
+			result = appendMetaFlag(result, 'O', f.token)
+		}
+	}
+	result = append(result, crlf...)
+	if res == storeStored && flags.has('v') {
+		result = append(result, it.value...)
+		result = append(result, crlf...)
+	}
+	_, _ = w.Write(result)
 }
 
-// flushAll() handles memcached `flush_all` command.
-func (m *MiniMemcached) flushAll(conn net.Conn) {
+// flush() removes every item.
+func (m *MiniMemcached) flush() {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	m.flushItems()
+}
+
+// flushItems() removes every item. The caller must hold the mutex of MiniMemcached.
+func (m *MiniMemcached) flushItems() {
 	_ = m.incrementCASToken()
-	m.items = map[string]*item{}
-	_, _ = conn.Write(resultOK)
+	m.unlinkAll()
+}
+
+// scheduleFlush() removes every item after delay seconds, or immediately when delay is not positive.
+// As an exptime does, a delay of more than 30 days is taken as a UNIX timestamp.
+// A flush already scheduled is replaced.
+func (m *MiniMemcached) scheduleFlush(delay int64) {
+	now := m.clock.Now().Unix()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counters.cmdFlush++
+	if m.flushTimer != nil {
+		m.flushTimer.Stop()
+		m.flushTimer = nil
+	}
+
+	if delay > int64(ttlUnixTimestamp) {
+		delay -= now
+	}
+	if delay <= 0 {
+		m.flushItems()
+		return
+	}
+	m.flushTimer = m.clock.AfterFunc(time.Duration(delay)*time.Second, m.flush)
+}
+
+// flushAll() handles memcached `flush_all` command.
+func (m *MiniMemcached) flushAll(delay int64, w io.Writer) {
+	m.scheduleFlush(delay)
+	_, _ = w.Write(resultOK)
 }
 
 // cas() handles memcached `cas` command.
-func (m *MiniMemcached) cas(key string, item *item, bytes int, casToken uint64, conn net.Conn) {
+func (m *MiniMemcached) cas(key string, item *item, bytes int, casToken uint64, w io.Writer) {
 	if !isLegalKey(key) {
-		_, _ = conn.Write(resultClientErrBadCliFormat)
+		_, _ = w.Write(resultClientErrBadCliFormat)
 		return
 	}
 	if !isLegalValue(bytes, item.value) {
-		_, _ = conn.Write(resultClientErrBadDataChunk)
+		_, _ = w.Write(resultClientErrBadDataChunk)
 		return
 	}
 
-	m.invalidate(key)
+	_, _ = w.Write(storeResults[m.store(modeCAS, key, item, casToken, false)])
+}
+
+// setVerbosity() handles memcached `verbosity` command.
+// It changes the level of the logs mini-memcached writes.
+func (m *MiniMemcached) setVerbosity(level uint64, w io.Writer) {
+	if level > math.MaxUint32 {
+		level = math.MaxUint32
+	}
+	atomic.StoreUint32(&m.verbosity, uint32(level))
+	_, _ = w.Write(resultOK)
+}
 
+// slabsReassign() handles memcached `slabs reassign` command.
+func (m *MiniMemcached) slabsReassign(src, dst int, w io.Writer) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	prevItem := m.items[key]
-	if prevItem == nil {
-		_, _ = conn.Write(resultNotFound)
+	if !m.slabsEnabled {
+		_, _ = w.Write(resultClientErrSlabReassignDisabled)
 		return
 	}
-	if prevItem.casToken != casToken {
-		_, _ = conn.Write(resultExists)
+	_, _ = w.Write(reassignResults[m.reassign(src, dst)])
+}
+
+// slabsAutomove() handles memcached `slabs automove` command.
+func (m *MiniMemcached) slabsAutomove(mode slabAutomove, w io.Writer) {
+	m.setSlabAutomove(mode)
+	_, _ = w.Write(resultOK)
+}
+
+// cacheMemlimit() handles memcached `cache_memlimit` command.
+// Items are evicted at once when they do not fit in the new limit.
+func (m *MiniMemcached) cacheMemlimit(megabytes uint64, w io.Writer) {
+	if megabytes < minMemlimit {
+		_, _ = w.Write(resultMemlimitTooSmall)
+		return
+	}
+	if megabytes > math.MaxInt64/megabyte {
+		megabytes = math.MaxInt64 / megabyte
+	}
+
+	m.setMemoryLimit(int64(megabytes) * megabyte)
+	_, _ = w.Write(resultOK)
+}
+
+// shutdown() handles memcached `shutdown` command.
+// A graceful shutdown stops accepting connections, and closes mini-memcached once every client
+// has disconnected. Otherwise, mini-memcached is closed at once.
+func (m *MiniMemcached) shutdown(graceful bool) {
+	if !graceful {
+		m.Close()
 		return
 	}
 
-	item.casToken = m.incrementCASToken()
-	m.items[key] = item
-	_, _ = conn.Write(resultStored)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.draining = true
+	m.close()
+}
+
+// stats() handles memcached `stats` command.
+// group is the name of the sub-command, or empty for the general-purpose statistics.
+func (m *MiniMemcached) stats(group string, w io.Writer) {
+	if group == statsReset {
+		m.resetStats()
+		_, _ = w.Write(resultReset)
+		return
+	}
+
+	stats, ok := m.statsGroup(group)
+	if !ok {
+		_, _ = w.Write(resultErr)
+		return
+	}
+	writeStats(stats, w)
+}
+
+// statsDetail() handles memcached `stats detail` command.
+func (m *MiniMemcached) statsDetail(subcommand string, w io.Writer) {
+	switch subcommand {
+	case "on":
+		m.setDetail(true)
+		_, _ = w.Write(resultOK)
+	case "off":
+		m.setDetail(false)
+		_, _ = w.Write(resultOK)
+	case "dump":
+		m.writePrefixStats(w)
+	default:
+		_, _ = w.Write(resultClientErrStatsDetailUsage)
+	}
+}
+
+// crawl() returns copies of the unexpired items in classes, sorted by key.
+// Items of every slab class are returned when classes is nil. Expired items are reclaimed as they are crawled.
+func (m *MiniMemcached) crawl(classes map[int]bool) ([]string, []item) {
+	m.mu.RLock()
+	keys := make([]string, 0, len(m.items))
+	for k := range m.items {
+		keys = append(keys, k)
+	}
+	m.mu.RUnlock()
+	sort.Strings(keys)
+
+	crawledKeys := make([]string, 0, len(keys))
+	crawledItems := make([]item, 0, len(keys))
+	for _, k := range keys {
+		m.invalidate(k)
+		m.mu.RLock()
+		if it := m.items[k]; it != nil && (classes == nil || classes[m.slabClassID(it.size(k))]) {
+			crawledKeys = append(crawledKeys, k)
+			crawledItems = append(crawledItems, *it)
+		}
+		m.mu.RUnlock()
+	}
+	return crawledKeys, crawledItems
+}
+
+// metadump() handles memcached `lru_crawler metadump` command.
+func (m *MiniMemcached) metadump(classes map[int]bool, w io.Writer) {
+	keys, items := m.crawl(classes)
+	result := make([]byte, 0)
+	for i, k := range keys {
+		it := items[i]
+		exp := it.expiresAt
+		if exp == 0 {
+			exp = -1
+		}
+		fetch := "no"
+		if it.fetched {
+			fetch = "yes"
+		}
+		size := it.size(k)
+		result = append(result, []byte(fmt.Sprintf("key=%s exp=%d la=%d cas=%d fetch=%s cls=%d size=%d\n",
+			uriEncode(k), exp, it.lastAccessedAt, it.casToken, fetch, m.slabClassID(size), size))...)
+	}
+	result = append(result, resultEnd...)
+	_, _ = w.Write(result)
+}
+
+// mgdump() handles memcached `lru_crawler mgdump` command.
+// It writes a `mg` request for every item, so that the output can be replayed to fetch them.
+func (m *MiniMemcached) mgdump(classes map[int]bool, w io.Writer) {
+	keys, _ := m.crawl(classes)
+	result := make([]byte, 0)
+	for _, k := range keys {
+		result = append(result, []byte(fmt.Sprintf("%s %s\r\n", metaGetCmd, k))...)
+	}
+	result = append(result, metaMiss...)
+	result = append(result, crlf...)
+	_, _ = w.Write(result)
 }
 
 // version() handles memcached `version` command,
-func (m *MiniMemcached) version(conn net.Conn) {
-	_, _ = conn.Write(resultVersion)
+func (m *MiniMemcached) version(w io.Writer) {
+	_, _ = w.Write(resultVersion)
 }
@@ -0,0 +1,98 @@
+package minimemcached
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+)
+
+// maxConns is the maximum number of client connections served at once, as memcached's default `-c`.
+const maxConns = 1024
+
+// connState is the state of a client connection, named as memcached reports it in `stats conns`.
+type connState string
+
+const (
+	// connWaiting is the state of a connection waiting for a request.
+	connWaiting connState = "conn_waiting"
+	// connParseCmd is the state of a connection whose request is being served.
+	connParseCmd connState = "conn_parse_cmd"
+)
+
+// connection is a client connection registered to mini-memcached.
+// Its state and lastCmdAt are guarded by the mutex of MiniMemcached.
+type connection struct {
+	id    int
+	conn  net.Conn
+	state connState
+	// lastCmdAt is UNIX timestamp of the time when the last request has been received.
+	lastCmdAt int64
+}
+
+// register() registers conn as a client connection, and returns it.
+// It reports false when mini-memcached already serves maxConns connections.
+func (m *MiniMemcached) register(conn net.Conn) (*connection, bool) {
+	now := m.clock.Now().Unix()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.conns) >= maxConns {
+		m.counters.rejectedConnections++
+		return nil, false
+	}
+
+	m.lastConnID++
+	c := &connection{id: m.lastConnID, conn: conn, state: connWaiting, lastCmdAt: now}
+	m.conns[c.id] = c
+	m.counters.totalConnections++
+	return c, true
+}
+
+// unregister() removes c from the registered client connections.
+// mini-memcached is closed once the last client connection is removed during a graceful shutdown.
+func (m *MiniMemcached) unregister(c *connection) {
+	m.mu.Lock()
+	delete(m.conns, c.id)
+	drained := m.draining && len(m.conns) == 0
+	m.mu.Unlock()
+
+	if drained {
+		m.Close()
+	}
+}
+
+// setConnState() sets the state of c. Entering connParseCmd records that a request has been received.
+func (m *MiniMemcached) setConnState(c *connection, state connState) {
+	now := m.clock.Now().Unix()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c.state = state
+	if state == connParseCmd {
+		c.lastCmdAt = now
+	}
+}
+
+// connsStats() returns the statistics of every registered client connection, as `stats conns` does.
+func (m *MiniMemcached) connsStats() []stat {
+	now := m.clock.Now().Unix()
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	ids := make([]int, 0, len(m.conns))
+	for id := range m.conns {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	stats := make([]stat, 0, len(ids)*4)
+	for _, id := range ids {
+		c := m.conns[id]
+		prefix := fmt.Sprintf("%d:", id)
+		stats = append(stats,
+			stat{prefix + "addr", "tcp:" + c.conn.RemoteAddr().String()},
+			stat{prefix + "listen_addr", "tcp:" + c.conn.LocalAddr().String()},
+			stat{prefix + "state", string(c.state)},
+			stat{prefix + "secs_since_last_cmd", strconv.FormatInt(now-c.lastCmdAt, 10)},
+		)
+	}
+	return stats
+}
@@ -3,20 +3,48 @@ package minimemcached
 import "fmt"
 
 const (
-	getCmd      = "get"
-	getsCmd     = "gets"
-	casCmd      = "cas"
-	setCmd      = "set"
-	touchCmd    = "touch"
-	addCmd      = "add"
-	replaceCmd  = "replace"
-	appendCmd   = "append"
-	prependCmd  = "prepend"
-	deleteCmd   = "delete"
-	incrCmd     = "incr"
-	decrCmd     = "decr"
-	flushAllCmd = "flush_all"
-	versionCmd  = "version"
+	getCmd            = "get"
+	getsCmd           = "gets"
+	gatCmd            = "gat"
+	gatsCmd           = "gats"
+	casCmd            = "cas"
+	setCmd            = "set"
+	touchCmd          = "touch"
+	addCmd            = "add"
+	replaceCmd        = "replace"
+	appendCmd         = "append"
+	prependCmd        = "prepend"
+	deleteCmd         = "delete"
+	incrCmd           = "incr"
+	decrCmd           = "decr"
+	flushAllCmd       = "flush_all"
+	versionCmd        = "version"
+	verbosityCmd      = "verbosity"
+	statsCmd          = "stats"
+	lruCrawlerCmd     = "lru_crawler"
+	quitCmd           = "quit"
+	shutdownCmd       = "shutdown"
+	cacheMemlimitCmd  = "cache_memlimit"
+	slabsCmd          = "slabs"
+	metaGetCmd        = "mg"
+	metaSetCmd        = "ms"
+	metaDeleteCmd     = "md"
+	metaArithmeticCmd = "ma"
+	metaNoOpCmd       = "mn"
+	metaDebugCmd      = "me"
+)
+
+const (
+	noreply     = "noreply"
+	statsReset  = "reset"
+	statsDetail = "detail"
+	graceful    = "graceful"
+
+	lruCrawlerMetadump = "metadump"
+	lruCrawlerMgdump   = "mgdump"
+
+	slabsReassign = "reassign"
+	slabsAutomove = "automove"
 )
 
 var (
@@ -33,13 +61,97 @@ var (
 	resultClientErrIncrDecrNonNumericValue = []byte("CLIENT_ERROR cannot increment or decrement non-numeric value\r\n")
 	resultClientErrInvalidNumericDeltaArg  = []byte("CLIENT_ERROR invalid numeric delta argument\r\n")
 	resultClientErrInvalidExpTimeArg       = []byte("CLIENT_ERROR invalid exptime argument\r\n")
+	resultClientErrUnauthenticated         = []byte("CLIENT_ERROR unauthenticated\r\n")
+	resultClientErrAuthFailure             = []byte("CLIENT_ERROR authentication failure\r\n")
+	resultClientErrInvalidFlag             = []byte("CLIENT_ERROR invalid flag\r\n")
+	resultClientErrDuplicateFlag           = []byte("CLIENT_ERROR duplicate flag\r\n")
+	resultClientErrOpaqueTooLong           = []byte("CLIENT_ERROR opaque token too long\r\n")
+	resultClientErrBadToken                = []byte("CLIENT_ERROR bad token in command line format\r\n")
+	resultClientErrInvalidMode             = []byte("CLIENT_ERROR invalid mode for ms STORE\r\n")
+	resultClientErrInvalidArithmeticMode   = []byte("CLIENT_ERROR invalid mode for ma M token\r\n")
+	resultClientErrStatsDetailUsage        = []byte("CLIENT_ERROR usage: stats detail on|off|dump\r\n")
+	resultClientErrSlabReassignDisabled    = []byte("CLIENT_ERROR slab reassignment disabled\r\n")
+	resultMetaNoOp                         = []byte("MN\r\n")
 	resultEnd                              = []byte("END\r\n")
+	resultReset                            = []byte("RESET\r\n")
+	resultServerErrOutOfMemory             = []byte("SERVER_ERROR out of memory storing object\r\n")
+	resultServerErrObjectTooLarge          = []byte("SERVER_ERROR object too large for cache\r\n")
+	resultMemlimitTooSmall                 = []byte("MEMLIMIT_TOO_SMALL cannot set maxbytes to less than 8m\r\n")
+	resultErrShutdownNotEnabled            = []byte("ERROR: shutdown not enabled\r\n")
+	resultErrTooManyConns                  = []byte("ERROR Too many open connections\r\n")
+	resultBadClass                         = []byte("BADCLASS invalid src or dst class id\r\n")
+	resultNoSpare                          = []byte("NOSPARE source class has no spare pages\r\n")
+	resultSame                             = []byte("SAME src and dst class are identical\r\n")
 	resultErr                              = []byte("ERROR\r\n")
 	resultVersion                          = []byte(fmt.Sprintf("VERSION mini-memcached %s\r\n", Version))
 	value                                  = "VALUE"
+	statPrefix                             = "STAT"
+	metaValue                              = "VA"
+	metaHit                                = "HD"
+	metaMiss                               = "EN"
+	metaDebug                              = "ME"
 )
 
 const (
 	maxKeyLength     int   = 250
 	ttlUnixTimestamp int32 = 60 * 60 * 24 * 30
 )
+
+// storeMode is the way a storage command stores an item.
+type storeMode int
+
+const (
+	modeSet storeMode = iota
+	modeAdd
+	modeReplace
+	modeAppend
+	modePrepend
+	modeCAS
+)
+
+// storeResult is the result of a command which modifies stored items.
+type storeResult int
+
+const (
+	storeStored storeResult = iota
+	storeNotStored
+	storeExists
+	storeNotFound
+	storeNonNumeric
+	storeOutOfMemory
+	storeTooLarge
+)
+
+var (
+	// storeResults are the replies of classic storage commands for each storeResult.
+	storeResults = map[storeResult][]byte{
+		storeStored:      resultStored,
+		storeNotStored:   resultNotStored,
+		storeExists:      resultExists,
+		storeNotFound:    resultNotFound,
+		storeOutOfMemory: resultServerErrOutOfMemory,
+		storeTooLarge:    resultServerErrObjectTooLarge,
+	}
+	// metaStoreResults are the return codes of meta commands for each storeResult.
+	metaStoreResults = map[storeResult]string{
+		storeStored:    metaHit,
+		storeNotStored: "NS",
+		storeExists:    "EX",
+		storeNotFound:  "NF",
+	}
+	// reassignResults are the replies of `slabs reassign` for each reassignResult.
+	reassignResults = map[reassignResult][]byte{
+		reassignOK:       resultOK,
+		reassignBadClass: resultBadClass,
+		reassignNoSpare:  resultNoSpare,
+		reassignSame:     resultSame,
+	}
+	// metaSetModes are the storeModes for each mode switch of `ms` command.
+	metaSetModes = map[string]storeMode{
+		"E": modeAdd,
+		"A": modeAppend,
+		"P": modePrepend,
+		"R": modeReplace,
+		"S": modeSet,
+	}
+)
@@ -0,0 +1,90 @@
+package minimemcached
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// defaultPrefixDelimiter is the default delimiter between key prefixes and ids, as memcached's default `-D`.
+const defaultPrefixDelimiter = ':'
+
+// PrefixStats are the statistics of the keys sharing a prefix, collected while detailed stats are on.
+type PrefixStats struct {
+	// Gets is the number of items requested by retrieval commands.
+	Gets uint64
+	// Hits is the number of requested items which have been found.
+	Hits uint64
+	// Sets is the number of storage commands.
+	Sets uint64
+	// Deletes is the number of deletion commands.
+	Deletes uint64
+}
+
+// WithPrefixDelimiter turns detailed stats on, and splits key prefixes on delimiter,
+// as memcached does with `-D`.
+func WithPrefixDelimiter(delimiter byte) Option {
+	return func(m *MiniMemcached) {
+		m.prefixDelimiter = delimiter
+		m.detailEnabled = true
+	}
+}
+
+// PrefixStats returns the statistics collected while detailed stats are on, indexed by key prefix.
+// Keys without the prefix delimiter are not counted.
+func (m *MiniMemcached) PrefixStats() map[string]PrefixStats {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	stats := make(map[string]PrefixStats, len(m.prefixStats))
+	for prefix, s := range m.prefixStats {
+		stats[prefix] = *s
+	}
+	return stats
+}
+
+// prefixStatsOf() returns the statistics of the prefix of key to be counted.
+// It returns nil when detailed stats are off or key has no prefix.
+// The caller must hold the mutex of MiniMemcached.
+func (m *MiniMemcached) prefixStatsOf(key string) *PrefixStats {
+	if !m.detailEnabled {
+		return nil
+	}
+	i := strings.IndexByte(key, m.prefixDelimiter)
+	if i < 0 {
+		return nil
+	}
+
+	prefix := key[:i]
+	s := m.prefixStats[prefix]
+	if s == nil {
+		s = &PrefixStats{}
+		m.prefixStats[prefix] = s
+	}
+	return s
+}
+
+// setDetail() turns detailed stats on or off. The statistics collected so far are kept.
+func (m *MiniMemcached) setDetail(enabled bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.detailEnabled = enabled
+}
+
+// writePrefixStats() writes the per-prefix statistics as memcached `stats detail dump` does.
+func (m *MiniMemcached) writePrefixStats(w io.Writer) {
+	stats := m.PrefixStats()
+	prefixes := make([]string, 0, len(stats))
+	for prefix := range stats {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+
+	result := make([]byte, 0)
+	for _, prefix := range prefixes {
+		s := stats[prefix]
+		result = append(result, []byte(fmt.Sprintf("PREFIX %s get %d hit %d set %d del %d\r\n", prefix, s.Gets, s.Hits, s.Sets, s.Deletes))...)
+	}
+	result = append(result, resultEnd...)
+	_, _ = w.Write(result)
+}
@@ -1,162 +1,290 @@
 package minimemcached
 
 import (
-	"net"
+	"io"
 	"strconv"
 	"strings"
 )
 
 // handleGet() handles `get` request.
-func handleGet(m *MiniMemcached, cmdLine []string, conn net.Conn) {
+func handleGet(m *MiniMemcached, cmdLine []string, w io.Writer) {
 	if len(cmdLine) == 1 {
-		_, _ = conn.Write(resultErr)
+		_, _ = w.Write(resultErr)
 		return
 	}
-	key := cmdLine[2]
 
-	m.gets([]string{key}, conn)
+	m.gets(cmdLine[1:], false, w)
 }
 
 // handleGets() handles `gets` request.
-func handleGets(m *MiniMemcached, cmdLine []string, conn net.Conn) {
+func handleGets(m *MiniMemcached, cmdLine []string, w io.Writer) {
 	if len(cmdLine) == 1 {
-		_, _ = conn.Write(resultErr)
+		_, _ = w.Write(resultErr)
 		return
 	}
 	cmdLine[len(cmdLine)-1] = strings.TrimSuffix(cmdLine[len(cmdLine)-1], string(crlf))
 
-	m.gets(cmdLine[1:], conn)
+	m.gets(cmdLine[1:], true, w)
+}
+
+// handleGat() handles `gat` and `gats` requests.
+func handleGat(m *MiniMemcached, cmdLine []string, withCAS bool, w io.Writer) {
+	if len(cmdLine) < 3 {
+		_, _ = w.Write(resultErr)
+		return
+	}
+
+	expiration, err := strconv.ParseInt(cmdLine[1], 10, 32)
+	if err != nil {
+		_, _ = w.Write(resultClientErrInvalidExpTimeArg)
+		return
+	}
+
+	m.gat(expiration, cmdLine[2:], withCAS, w)
+}
+
+// handleMetaGet() handles `mg` requests.
+func handleMetaGet(m *MiniMemcached, cmdLine []string, w io.Writer) {
+	if len(cmdLine) < 2 || cmdLine[1] == "" {
+		_, _ = w.Write(resultClientErrBadCliFormat)
+		return
+	}
+
+	flags, errResult := parseMetaFlags(cmdLine[2:], "cfhklOqstuvNRT", "NRT")
+	if errResult != nil {
+		_, _ = w.Write(errResult)
+		return
+	}
+
+	m.metaGet(cmdLine[1], flags, w)
+}
+
+// handleMetaSet() handles `ms` requests.
+func handleMetaSet(m *MiniMemcached, cmdLine []string, value []byte, w io.Writer) {
+	if len(cmdLine) < 3 || cmdLine[1] == "" {
+		_, _ = w.Write(resultClientErrBadCliFormat)
+		return
+	}
+
+	bytes, err := strconv.Atoi(cmdLine[2])
+	if err != nil || bytes < 0 {
+		_, _ = w.Write(resultClientErrBadDataChunk)
+		return
+	}
+
+	flags, errResult := parseMetaFlags(cmdLine[3:], "cCEFIkMOqT", "CEFT")
+	if errResult != nil {
+		_, _ = w.Write(errResult)
+		return
+	}
+
+	mode := modeSet
+	if token, ok := flags.token('M'); ok {
+		if mode, ok = metaSetModes[strings.ToUpper(token)]; !ok {
+			_, _ = w.Write(resultClientErrInvalidMode)
+			return
+		}
+	}
+
+	m.metaSet(cmdLine[1], mode, flags, bytes, value, w)
+}
+
+// handleMetaDelete() handles `md` requests.
+func handleMetaDelete(m *MiniMemcached, cmdLine []string, w io.Writer) {
+	if len(cmdLine) < 2 || cmdLine[1] == "" {
+		_, _ = w.Write(resultClientErrBadCliFormat)
+		return
+	}
+
+	flags, errResult := parseMetaFlags(cmdLine[2:], "CIkOqT", "CT")
+	if errResult != nil {
+		_, _ = w.Write(errResult)
+		return
+	}
+
+	m.metaDelete(cmdLine[1], flags, w)
+}
+
+// handleMetaArithmetic() handles `ma` requests.
+func handleMetaArithmetic(m *MiniMemcached, cmdLine []string, w io.Writer) {
+	if len(cmdLine) < 2 || cmdLine[1] == "" {
+		_, _ = w.Write(resultClientErrBadCliFormat)
+		return
+	}
+
+	flags, errResult := parseMetaFlags(cmdLine[2:], "cCDJkMNOqtTv", "CDJNT")
+	if errResult != nil {
+		_, _ = w.Write(errResult)
+		return
+	}
+
+	incr := true
+	if token, ok := flags.token('M'); ok {
+		switch strings.ToUpper(token) {
+		case "I", "+":
+		case "D", "-":
+			incr = false
+		default:
+			_, _ = w.Write(resultClientErrInvalidArithmeticMode)
+			return
+		}
+	}
+
+	m.metaArithmetic(cmdLine[1], incr, flags, w)
+}
+
+// handleMetaNoOp() handles `mn` requests.
+func handleMetaNoOp(m *MiniMemcached, w io.Writer) {
+	m.metaNoOp(w)
+}
+
+// handleMetaDebug() handles `me` requests.
+func handleMetaDebug(m *MiniMemcached, cmdLine []string, w io.Writer) {
+	if len(cmdLine) != 2 || cmdLine[1] == "" {
+		_, _ = w.Write(resultClientErrBadCliFormat)
+		return
+	}
+
+	m.metaDebug(cmdLine[1], w)
 }
 
 // handleSet() handles `set` request.
-func handleSet(m *MiniMemcached, cmdLine []string, value []byte, conn net.Conn) {
+func handleSet(m *MiniMemcached, cmdLine []string, value []byte, w io.Writer) {
+	cmdLine, w = parseNoreply(cmdLine, w)
 	if len(cmdLine) != 5 {
-		_, _ = conn.Write(resultErr)
+		_, _ = w.Write(resultErr)
 		return
 	}
 	key := cmdLine[1]
 
 	flags, err := strconv.ParseUint(cmdLine[2], 0, 32)
 	if err != nil {
-		_, _ = conn.Write(resultErr)
+		_, _ = w.Write(resultErr)
 		return
 	}
 
 	expiration, err := strconv.ParseInt(cmdLine[3], 0, 32)
 	if err != nil {
-		_, _ = conn.Write(resultErr)
+		_, _ = w.Write(resultErr)
 		return
 	}
 
 	bytes, err := strconv.Atoi(cmdLine[4])
 	if err != nil {
-		_, _ = conn.Write(resultErr)
+		_, _ = w.Write(resultErr)
 		return
 	}
 
+	now := m.clock.Now().Unix()
 	item := &item{
-		flags:      uint32(flags),
-		value:      value,
-		expiration: int32(expiration),
-		createdAt:  m.clock.Now().Unix(),
+		flags:          uint32(flags),
+		value:          value,
+		expiresAt:      deadline(expiration, now),
+		lastAccessedAt: now,
 	}
 
-	m.set(key, item, bytes, conn)
+	m.set(key, item, bytes, w)
 }
 
 // handleAdd() handles `add` request.
-func handleAdd(m *MiniMemcached, cmdLine []string, value []byte, conn net.Conn) {
+func handleAdd(m *MiniMemcached, cmdLine []string, value []byte, w io.Writer) {
+	cmdLine, w = parseNoreply(cmdLine, w)
 	if len(cmdLine) != 5 {
-		_, _ = conn.Write(resultErr)
+		_, _ = w.Write(resultErr)
 		return
 	}
 	key := cmdLine[1]
 
 	flags, err := strconv.ParseUint(cmdLine[2], 0, 32)
 	if err != nil {
-		_, _ = conn.Write(resultErr)
+		_, _ = w.Write(resultErr)
 		return
 	}
 
 	expiration, err := strconv.ParseInt(cmdLine[3], 0, 32)
 	if err != nil {
-		_, _ = conn.Write(resultErr)
+		_, _ = w.Write(resultErr)
 		return
 	}
 
 	bytes, err := strconv.Atoi(cmdLine[4])
 	if err != nil {
-		_, _ = conn.Write(resultErr)
+		_, _ = w.Write(resultErr)
 		return
 	}
 
+	now := m.clock.Now().Unix()
 	item := &item{
-		flags:      uint32(flags),
-		value:      value,
-		expiration: int32(expiration),
-		createdAt:  m.clock.Now().Unix(),
+		flags:          uint32(flags),
+		value:          value,
+		expiresAt:      deadline(expiration, now),
+		lastAccessedAt: now,
 	}
 
-	m.add(key, item, bytes, conn)
+	m.add(key, item, bytes, w)
 }
 
 // handleReplace() handles `replace` request.
-func handleReplace(m *MiniMemcached, cmdLine []string, value []byte, conn net.Conn) {
+func handleReplace(m *MiniMemcached, cmdLine []string, value []byte, w io.Writer) {
+	cmdLine, w = parseNoreply(cmdLine, w)
 	if len(cmdLine) != 5 {
-		_, _ = conn.Write(resultErr)
+		_, _ = w.Write(resultErr)
 		return
 	}
 	key := cmdLine[1]
 
 	flags, err := strconv.ParseUint(cmdLine[2], 0, 32)
 	if err != nil {
-		_, _ = conn.Write(resultErr)
+		_, _ = w.Write(resultErr)
 		return
 	}
 
 	expiration, err := strconv.ParseInt(cmdLine[3], 0, 32)
 	if err != nil {
-		_, _ = conn.Write(resultErr)
+		_, _ = w.Write(resultErr)
 		return
 	}
 
 	bytes, err := strconv.Atoi(cmdLine[4])
 	if err != nil {
-		_, _ = conn.Write(resultErr)
+		_, _ = w.Write(resultErr)
 		return
 	}
 
+	now := m.clock.Now().Unix()
 	item := &item{
-		flags:      uint32(flags),
-		value:      value,
-		expiration: int32(expiration),
-		createdAt:  m.clock.Now().Unix(),
+		flags:          uint32(flags),
+		value:          value,
+		expiresAt:      deadline(expiration, now),
+		lastAccessedAt: now,
 	}
 
-	m.replace(key, item, bytes, conn)
+	m.replace(key, item, bytes, w)
 }
 
 // handleAppend() handles `append` requests.
-func handleAppend(m *MiniMemcached, cmdLine []string, value []byte, conn net.Conn) {
+func handleAppend(m *MiniMemcached, cmdLine []string, value []byte, w io.Writer) {
+	cmdLine, w = parseNoreply(cmdLine, w)
 	if len(cmdLine) != 5 {
-		_, _ = conn.Write(resultErr)
+		_, _ = w.Write(resultErr)
 		return
 	}
 
 	key := cmdLine[1]
 	bytes, err := strconv.Atoi(cmdLine[4])
 	if err != nil {
-		_, _ = conn.Write(resultErr)
+		_, _ = w.Write(resultErr)
 		return
 	}
 
-	m.append(key, bytes, value, conn)
+	m.append(key, bytes, value, w)
 }
 
 // handlePrepend() handles `prepend` requests.
-func handlePrepend(m *MiniMemcached, cmdLine []string, value []byte, conn net.Conn) {
+func handlePrepend(m *MiniMemcached, cmdLine []string, value []byte, w io.Writer) {
+	cmdLine, w = parseNoreply(cmdLine, w)
 	if len(cmdLine) != 5 {
-		_, _ = conn.Write(resultErr)
+		_, _ = w.Write(resultErr)
 		return
 	}
 
@@ -164,29 +292,31 @@ func handlePrepend(m *MiniMemcached, cmdLine []string, value []byte, conn net.Co
 
 	bytes, err := strconv.Atoi(cmdLine[4])
 	if err != nil {
-		_, _ = conn.Write(resultErr)
+		_, _ = w.Write(resultErr)
 		return
 	}
 
-	m.prepend(key, bytes, value, conn)
+	m.prepend(key, bytes, value, w)
 }
 
 // handleDelete() handles `delete` requests.
-func handleDelete(m *MiniMemcached, cmdLine []string, conn net.Conn) {
+func handleDelete(m *MiniMemcached, cmdLine []string, w io.Writer) {
+	cmdLine, w = parseNoreply(cmdLine, w)
 	if len(cmdLine) != 2 {
-		_, _ = conn.Write(resultErr)
+		_, _ = w.Write(resultErr)
 		return
 	}
 
 	key := cmdLine[1]
 
-	m.delete(key, conn)
+	m.delete(key, w)
 }
 
 // handleIncr() handles `incr` requests.
-func handleIncr(m *MiniMemcached, cmdLine []string, conn net.Conn) {
+func handleIncr(m *MiniMemcached, cmdLine []string, w io.Writer) {
+	cmdLine, w = parseNoreply(cmdLine, w)
 	if len(cmdLine) != 3 {
-		_, _ = conn.Write(resultErr)
+		_, _ = w.Write(resultErr)
 		return
 	}
 
@@ -194,17 +324,18 @@ func handleIncr(m *MiniMemcached, cmdLine []string, conn net.Conn) {
 	incrValue := cmdLine[2]
 	numericIncrValue, isNumeric := getNumericValueFromString(incrValue)
 	if !isNumeric {
-		_, _ = conn.Write(resultClientErrInvalidNumericDeltaArg)
+		_, _ = w.Write(resultClientErrInvalidNumericDeltaArg)
 		return
 	}
 
-	m.incr(key, numericIncrValue, conn)
+	m.incr(key, numericIncrValue, w)
 }
 
 // handleDecr() handles `decr` requests.
-func handleDecr(m *MiniMemcached, cmdLine []string, conn net.Conn) {
+func handleDecr(m *MiniMemcached, cmdLine []string, w io.Writer) {
+	cmdLine, w = parseNoreply(cmdLine, w)
 	if len(cmdLine) != 3 {
-		_, _ = conn.Write(resultErr)
+		_, _ = w.Write(resultErr)
 		return
 	}
 
@@ -212,17 +343,18 @@ func handleDecr(m *MiniMemcached, cmdLine []string, conn net.Conn) {
 	decrValue := cmdLine[2]
 	numericDecrValue, isNumeric := getNumericValueFromString(decrValue)
 	if !isNumeric {
-		_, _ = conn.Write(resultClientErrInvalidNumericDeltaArg)
+		_, _ = w.Write(resultClientErrInvalidNumericDeltaArg)
 		return
 	}
 
-	m.decr(key, numericDecrValue, conn)
+	m.decr(key, numericDecrValue, w)
 }
 
 // handleTouch() handles `touch` requests.
-func handleTouch(m *MiniMemcached, cmdLine []string, conn net.Conn) {
+func handleTouch(m *MiniMemcached, cmdLine []string, w io.Writer) {
+	cmdLine, w = parseNoreply(cmdLine, w)
 	if len(cmdLine) != 3 {
-		_, _ = conn.Write(resultErr)
+		_, _ = w.Write(resultErr)
 		return
 	}
 
@@ -231,17 +363,18 @@ func handleTouch(m *MiniMemcached, cmdLine []string, conn net.Conn) {
 
 	expiration, err := strconv.ParseInt(expTime, 10, 32)
 	if err != nil {
-		_, _ = conn.Write(resultClientErrInvalidExpTimeArg)
+		_, _ = w.Write(resultClientErrInvalidExpTimeArg)
 		return
 	}
 
-	m.touch(key, int32(expiration), conn)
+	m.touch(key, expiration, w)
 }
 
 // handleCas() handles `cas` requests.
-func handleCas(m *MiniMemcached, cmdLine []string, value []byte, conn net.Conn) {
+func handleCas(m *MiniMemcached, cmdLine []string, value []byte, w io.Writer) {
+	cmdLine, w = parseNoreply(cmdLine, w)
 	if len(cmdLine) != 6 {
-		_, _ = conn.Write(resultErr)
+		_, _ = w.Write(resultErr)
 		return
 	}
 
@@ -249,49 +382,202 @@ func handleCas(m *MiniMemcached, cmdLine []string, value []byte, conn net.Conn)
 
 	flags, err := strconv.ParseUint(cmdLine[2], 0, 32)
 	if err != nil {
-		_, _ = conn.Write(resultErr)
+		_, _ = w.Write(resultErr)
 		return
 	}
 
 	expiration, err := strconv.ParseInt(cmdLine[3], 0, 32)
 	if err != nil {
-		_, _ = conn.Write(resultErr)
+		_, _ = w.Write(resultErr)
 		return
 	}
 
 	bytes, err := strconv.Atoi(cmdLine[4])
 	if err != nil {
-		_, _ = conn.Write(resultErr)
+		_, _ = w.Write(resultErr)
 		return
 	}
 
 	casToken, isNumeric := getNumericValueFromString(cmdLine[5])
 	if !isNumeric {
-		_, _ = conn.Write(resultClientErrBadCliFormat)
+		_, _ = w.Write(resultClientErrBadCliFormat)
 		return
 	}
 
+	now := m.clock.Now().Unix()
 	item := &item{
-		flags:      uint32(flags),
-		value:      value,
-		expiration: int32(expiration),
-		createdAt:  m.clock.Now().Unix(),
+		flags:          uint32(flags),
+		value:          value,
+		expiresAt:      deadline(expiration, now),
+		lastAccessedAt: now,
 	}
 
-	m.cas(key, item, bytes, casToken, conn)
+	m.cas(key, item, bytes, casToken, w)
 }
 
 // handleFlushAll() handles memcached `flush_all` requests.
-func handleFlushAll(m *MiniMemcached, conn net.Conn) {
-	m.flushAll(conn)
+func handleFlushAll(m *MiniMemcached, cmdLine []string, w io.Writer) {
+	cmdLine, w = parseNoreply(cmdLine, w)
+	if len(cmdLine) > 2 {
+		_, _ = w.Write(resultErr)
+		return
+	}
+
+	var delay int64
+	if len(cmdLine) == 2 {
+		var err error
+		if delay, err = strconv.ParseInt(cmdLine[1], 10, 32); err != nil {
+			_, _ = w.Write(resultClientErrBadCliFormat)
+			return
+		}
+	}
+
+	m.flushAll(delay, w)
 }
 
 // handleVersion() handles memcached `version` requests.
-func handleVersion(m *MiniMemcached, conn net.Conn) {
-	m.version(conn)
+func handleVersion(m *MiniMemcached, w io.Writer) {
+	m.version(w)
+}
+
+// handleStats() handles memcached `stats` requests.
+func handleStats(m *MiniMemcached, cmdLine []string, w io.Writer) {
+	if len(cmdLine) > 1 && strings.ToLower(cmdLine[1]) == statsDetail {
+		if len(cmdLine) != 3 {
+			_, _ = w.Write(resultClientErrStatsDetailUsage)
+			return
+		}
+		m.statsDetail(strings.ToLower(cmdLine[2]), w)
+		return
+	}
+
+	switch len(cmdLine) {
+	case 1:
+		m.stats("", w)
+	case 2:
+		m.stats(strings.ToLower(cmdLine[1]), w)
+	default:
+		handleErr(w)
+	}
+}
+
+// handleLRUCrawler() handles memcached `lru_crawler` requests.
+func handleLRUCrawler(m *MiniMemcached, cmdLine []string, w io.Writer) {
+	if len(cmdLine) != 3 {
+		_, _ = w.Write(resultErr)
+		return
+	}
+
+	var dump func(classes map[int]bool, w io.Writer)
+	switch strings.ToLower(cmdLine[1]) {
+	case lruCrawlerMetadump:
+		dump = m.metadump
+	case lruCrawlerMgdump:
+		dump = m.mgdump
+	default:
+		_, _ = w.Write(resultErr)
+		return
+	}
+
+	// `all` and `hash` both dump every item, since mini-memcached has no separate hash table to walk.
+	target := strings.ToLower(cmdLine[2])
+	if target == "all" || target == "hash" {
+		dump(nil, w)
+		return
+	}
+	classes := map[int]bool{}
+	for _, token := range strings.Split(target, ",") {
+		id, err := strconv.Atoi(token)
+		if err != nil || id < 1 || id >= len(m.slabClasses) {
+			_, _ = w.Write(resultClientErrBadCliFormat)
+			return
+		}
+		classes[id] = true
+	}
+	dump(classes, w)
+}
+
+// handleVerbosity() handles memcached `verbosity` requests.
+func handleVerbosity(m *MiniMemcached, cmdLine []string, w io.Writer) {
+	cmdLine, w = parseNoreply(cmdLine, w)
+	if len(cmdLine) != 2 {
+		_, _ = w.Write(resultErr)
+		return
+	}
+
+	level, isNumeric := getNumericValueFromString(cmdLine[1])
+	if !isNumeric {
+		_, _ = w.Write(resultClientErrBadCliFormat)
+		return
+	}
+
+	m.setVerbosity(level, w)
+}
+
+// handleSlabs() handles memcached `slabs reassign` and `slabs automove` requests.
+func handleSlabs(m *MiniMemcached, cmdLine []string, w io.Writer) {
+	switch {
+	case len(cmdLine) == 4 && strings.ToLower(cmdLine[1]) == slabsReassign:
+		src, err := strconv.Atoi(cmdLine[2])
+		if err != nil {
+			_, _ = w.Write(resultClientErrBadCliFormat)
+			return
+		}
+		dst, err := strconv.Atoi(cmdLine[3])
+		if err != nil {
+			_, _ = w.Write(resultClientErrBadCliFormat)
+			return
+		}
+		m.slabsReassign(src, dst, w)
+	case len(cmdLine) == 3 && strings.ToLower(cmdLine[1]) == slabsAutomove:
+		mode, err := strconv.Atoi(cmdLine[2])
+		if err != nil || mode < int(automoveOff) || mode > int(automoveAggressive) {
+			_, _ = w.Write(resultErr)
+			return
+		}
+		m.slabsAutomove(slabAutomove(mode), w)
+	default:
+		_, _ = w.Write(resultErr)
+	}
+}
+
+// handleCacheMemlimit() handles memcached `cache_memlimit` requests.
+func handleCacheMemlimit(m *MiniMemcached, cmdLine []string, w io.Writer) {
+	cmdLine, w = parseNoreply(cmdLine, w)
+	if len(cmdLine) != 2 {
+		_, _ = w.Write(resultErr)
+		return
+	}
+
+	megabytes, isNumeric := getNumericValueFromString(cmdLine[1])
+	if !isNumeric {
+		_, _ = w.Write(resultErr)
+		return
+	}
+
+	m.cacheMemlimit(megabytes, w)
+}
+
+// handleShutdown() handles memcached `shutdown` requests, and reports whether mini-memcached is shutting down.
+func handleShutdown(m *MiniMemcached, cmdLine []string, w io.Writer) bool {
+	if !m.shutdownEnabled {
+		_, _ = w.Write(resultErrShutdownNotEnabled)
+		return false
+	}
+
+	switch {
+	case len(cmdLine) == 1:
+		m.shutdown(false)
+	case len(cmdLine) == 2 && strings.ToLower(cmdLine[1]) == graceful:
+		m.shutdown(true)
+	default:
+		_, _ = w.Write(resultErr)
+		return false
+	}
+	return true
 }
 
 // handleErr() returns error to client when invalid request is made.
-func handleErr(conn net.Conn) {
-	_, _ = conn.Write(resultErr)
+func handleErr(w io.Writer) {
+	_, _ = w.Write(resultErr)
 }
@@ -0,0 +1,299 @@
+package minimemcached
+
+import (
+	"container/list"
+	"time"
+)
+
+const (
+	// megabyte is the unit of the memory limit set by `cache_memlimit`.
+	megabyte = 1024 * 1024
+	// minMemlimit is the smallest memory limit `cache_memlimit` accepts, in megabytes.
+	minMemlimit = 8
+	// hotLRUPercent is the share of the bytes used by items which HOT may use, as memcached's default.
+	hotLRUPercent = 20
+	// warmLRUPercent is the share of the bytes used by items which WARM may use, as memcached's default.
+	warmLRUPercent = 40
+	// lruMaintainerInterval is the interval between two runs of the LRU maintainer.
+	lruMaintainerInterval = time.Second
+)
+
+// lruSegment is a segment of the segmented LRU.
+type lruSegment int
+
+const (
+	// hotLRU holds the newly stored items.
+	hotLRU lruSegment = iota
+	// warmLRU holds the items which have been accessed more than once.
+	warmLRU
+	// coldLRU holds the items which are about to be evicted. When the LRU is not segmented,
+	// every item lives in coldLRU.
+	coldLRU
+	numLRUSegments
+)
+
+// newLRUs() returns the empty lists of every LRU segment.
+func newLRUs() [numLRUSegments]*list.List {
+	var lrus [numLRUSegments]*list.List
+	for i := range lrus {
+		lrus[i] = list.New()
+	}
+	return lrus
+}
+
+// WithSegmentedLRU splits the LRU into HOT, WARM and COLD segments, as memcached 1.5+ does.
+// New items start in HOT. Items accessed more than once become active, and an LRU maintainer
+// running every second of the clock moves them to WARM. The other items flow to COLD,
+// from where they are evicted.
+func WithSegmentedLRU() Option {
+	return func(m *MiniMemcached) {
+		m.lruSegmented = true
+	}
+}
+
+// link() stores it under key, replacing the item already stored, and marks it as the most recently used.
+// New items start in HOT when the LRU is segmented.
+// The caller must hold the mutex of MiniMemcached.
+func (m *MiniMemcached) link(key string, it *item) {
+	if m.items[key] != nil {
+		m.unlink(key)
+	}
+	it.segment = coldLRU
+	if m.lruSegmented {
+		it.segment = hotLRU
+	}
+	it.element = m.lrus[it.segment].PushFront(key)
+	m.addBytes(key, it, 1)
+	m.items[key] = it
+}
+
+// unlink() removes the item under key. The caller must hold the mutex of MiniMemcached.
+func (m *MiniMemcached) unlink(key string) {
+	it := m.items[key]
+	m.lrus[it.segment].Remove(it.element)
+	m.addBytes(key, it, -1)
+	delete(m.items, key)
+}
+
+// addBytes() adds the size of it, stored under key, sign times to the bytes used.
+// The caller must hold the mutex of MiniMemcached.
+func (m *MiniMemcached) addBytes(key string, it *item, sign int64) {
+	m.addChunks(it.size(key), int(sign))
+	size := sign * int64(it.size(key))
+	m.bytes += size
+	m.lruBytes[it.segment] += size
+}
+
+// bump() marks it as the most recently used item. The caller must hold the mutex of MiniMemcached.
+// Items of a segmented LRU are not moved, but left to the LRU maintainer.
+func (m *MiniMemcached) bump(it *item) {
+	if !m.lruSegmented {
+		m.lrus[it.segment].MoveToFront(it.element)
+	}
+}
+
+// move() moves the item under key to the head of segment. The caller must hold the mutex of MiniMemcached.
+func (m *MiniMemcached) move(key string, it *item, segment lruSegment) {
+	c := m.classCounters(m.slabClassID(it.size(key)))
+	switch {
+	case segment == coldLRU:
+		m.counters.movesToCold++
+		c.movesToCold++
+	case segment != it.segment:
+		m.counters.movesToWarm++
+		c.movesToWarm++
+	default:
+		m.counters.movesWithinLRU++
+		c.movesWithinLRU++
+	}
+
+	m.lrus[it.segment].Remove(it.element)
+	m.addBytes(key, it, -1)
+	it.segment = segment
+	it.element = m.lrus[segment].PushFront(key)
+	m.addBytes(key, it, 1)
+}
+
+// setValue() replaces the value of it, stored under key. The caller must hold the mutex of MiniMemcached.
+func (m *MiniMemcached) setValue(key string, it *item, value []byte) {
+	m.addBytes(key, it, -1)
+	it.value = value
+	m.addBytes(key, it, 1)
+}
+
+// unlinkAll() removes every item. The caller must hold the mutex of MiniMemcached.
+func (m *MiniMemcached) unlinkAll() {
+	m.items = map[string]*item{}
+	m.lrus = newLRUs()
+	m.lruBytes = [numLRUSegments]int64{}
+	m.bytes = 0
+	for id := range m.slabs {
+		m.slabs[id].usedChunks = 0
+	}
+}
+
+// reserve() makes room for an item of size by evicting the least recently used items,
+// and reports whether the item fits in the memory limit. With slab accounting, the item must fit in its slab class.
+// It evicts nothing and fails when evictions are disabled or the item is larger than the limit.
+// The caller must hold the mutex of MiniMemcached.
+func (m *MiniMemcached) reserve(size int) bool {
+	if m.slabsEnabled {
+		return m.reserveChunks(size)
+	}
+	if m.maxBytes == 0 || m.bytes+int64(size) <= m.maxBytes {
+		return true
+	}
+	if m.evictionsDisabled || int64(size) > m.maxBytes {
+		m.classCounters(m.slabClassID(size)).outOfMemory++
+		return false
+	}
+
+	m.evict(m.maxBytes - int64(size))
+	return true
+}
+
+// evict() removes the least recently used items of COLD until at most maxBytes are used.
+// When COLD is empty, items are pulled to it from the tail of HOT, and then of WARM.
+// Expired items are reclaimed rather than counted as evictions.
+// The caller must hold the mutex of MiniMemcached.
+func (m *MiniMemcached) evict(maxBytes int64) {
+	now := m.clock.Now().Unix()
+	for m.bytes > maxBytes && len(m.items) > 0 {
+		tail := m.lrus[coldLRU].Back()
+		if tail == nil {
+			if !m.pullTail(hotLRU, 0) {
+				m.pullTail(warmLRU, 0)
+			}
+			continue
+		}
+
+		key := tail.Value.(string)
+		m.evictItem(key, m.items[key], now)
+	}
+}
+
+// evictItem() removes it, stored under key, to make room for other items.
+// An expired item is reclaimed rather than counted as an eviction.
+// The caller must hold the mutex of MiniMemcached.
+func (m *MiniMemcached) evictItem(key string, it *item, now int64) {
+	if it.expired(now) {
+		m.reclaim(key)
+		return
+	}
+
+	id := m.slabClassID(it.size(key))
+	c := m.classCounters(id)
+	m.counters.evictions++
+	c.evicted++
+	c.evictedTime = now - it.lastAccessedAt
+	if it.expiresAt != 0 {
+		c.evictedNonzero++
+	}
+	if !it.fetched {
+		m.counters.evictedUnfetched++
+		c.evictedUnfetched++
+	}
+	m.slabs[id].recentEvictions++
+	m.unlink(key)
+}
+
+// pullTail() moves the item at the tail of segment, HOT or WARM, as memcached's LRU maintainer does.
+// An active item is rescued to WARM, and an inactive one is moved to COLD when segment uses more
+// than limit bytes. It reports whether an item has been moved.
+// The caller must hold the mutex of MiniMemcached.
+func (m *MiniMemcached) pullTail(segment lruSegment, limit int64) bool {
+	tail := m.lrus[segment].Back()
+	if tail == nil {
+		return false
+	}
+
+	key := tail.Value.(string)
+	it := m.items[key]
+	switch {
+	case it.active:
+		it.active = false
+		m.move(key, it, warmLRU)
+	case m.lruBytes[segment] > limit:
+		m.move(key, it, coldLRU)
+	default:
+		return false
+	}
+	return true
+}
+
+// maintainLRU() moves items between the segments of the LRU, as memcached's LRU maintainer does.
+// HOT and WARM are kept within their share of the bytes used by moving items to COLD,
+// and active items are rescued to WARM. It also runs the slab automover when it is on.
+func (m *MiniMemcached) maintainLRU() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.slabsEnabled {
+		m.automoveSlabs()
+	}
+	if !m.lruSegmented {
+		return
+	}
+
+	limits := [numLRUSegments]int64{
+		hotLRU:  m.bytes * hotLRUPercent / 100,
+		warmLRU: m.bytes * warmLRUPercent / 100,
+	}
+	for _, segment := range []lruSegment{hotLRU, warmLRU} {
+		for n := m.lrus[segment].Len(); n > 0; n-- {
+			if !m.pullTail(segment, limits[segment]) {
+				break
+			}
+		}
+	}
+
+	for e := m.lrus[coldLRU].Back(); e != nil; {
+		prev := e.Prev()
+		key := e.Value.(string)
+		if it := m.items[key]; it.active {
+			it.active = false
+			m.move(key, it, warmLRU)
+		}
+		e = prev
+	}
+}
+
+// startLRUMaintainer() runs maintainLRU() every lruMaintainerInterval of the clock,
+// until stopLRUMaintainer() is called.
+func (m *MiniMemcached) startLRUMaintainer() {
+	ticker := m.clock.Ticker(lruMaintainerInterval)
+	done := make(chan struct{})
+	m.lruMaintainer = ticker
+	m.lruMaintainerDone = done
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				m.maintainLRU()
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// stopLRUMaintainer() stops the LRU maintainer if it runs. The caller must hold the mutex of MiniMemcached.
+func (m *MiniMemcached) stopLRUMaintainer() {
+	if m.lruMaintainer == nil {
+		return
+	}
+	m.lruMaintainer.Stop()
+	close(m.lruMaintainerDone)
+	m.lruMaintainer = nil
+}
+
+// setMemoryLimit() sets the memory limit to maxBytes, and evicts items until they fit in it.
+// Items are kept when evictions are disabled. With slab accounting, the slab pages already allocated are kept,
+// and only the next allocations are limited.
+func (m *MiniMemcached) setMemoryLimit(maxBytes int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.maxBytes = maxBytes
+	if maxBytes != 0 && !m.evictionsDisabled && !m.slabsEnabled {
+		m.evict(maxBytes)
+	}
+}
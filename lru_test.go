@@ -0,0 +1,246 @@
+package minimemcached
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// Every item stored in these tests is made of a 1-byte key and a 4-byte value, so it uses 64 bytes.
+const lruTestItemSize = 64
+
+func TestLRUEviction(t *testing.T) {
+	m, err := Run(&Config{MaxBytes: 3 * lruTestItemSize}, WithClock(clk))
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	defer m.Close()
+
+	conn, err := net.Dial("tcp", fmt.Sprintf(":%d", m.Port()))
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	requests := []struct {
+		req  string
+		want string
+	}{
+		{"set a 0 0 4\r\naaaa\r\n", string(resultStored)},
+		{"set b 0 0 4\r\nbbbb\r\n", string(resultStored)},
+		{"set c 0 0 4\r\ncccc\r\n", string(resultStored)},
+		{"get a\r\n", "VALUE a 0 4\r\naaaa\r\nEND\r\n"},
+		{"set d 0 0 4\r\ndddd\r\n", string(resultStored)},
+		{"get b\r\n", string(resultEnd)},
+		{"get a c d\r\n", "VALUE a 0 4\r\naaaa\r\nVALUE c 0 4\r\ncccc\r\nVALUE d 0 4\r\ndddd\r\nEND\r\n"},
+		{"append a 0 0 4\r\naaaa\r\n", string(resultStored)},
+		{"get b c\r\n", string(resultEnd)},
+	}
+	for _, r := range requests {
+		if err := request(conn, r.req, r.want); err != nil {
+			t.Errorf("%q: %v", r.req, err)
+			return
+		}
+	}
+
+	stats, err := readStats(conn, "stats\r\n")
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	for name, value := range map[string]string{"evictions": "2", "evicted_unfetched": "1", "curr_items": "2", "bytes": "132", "limit_maxbytes": "192"} {
+		if stats[name] != value {
+			t.Errorf("%s: want: %q, got: %q", name, value, stats[name])
+		}
+	}
+	items, err := readStats(conn, "stats items\r\n")
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	for name, value := range map[string]string{"items:1:evicted": "2", "items:1:evicted_unfetched": "1", "items:1:number": "2"} {
+		if items[name] != value {
+			t.Errorf("%s: want: %q, got: %q", name, value, items[name])
+		}
+	}
+}
+
+func TestDisableEvictions(t *testing.T) {
+	m, err := Run(&Config{MaxBytes: 2 * lruTestItemSize, DisableEvictions: true}, WithClock(clk))
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	defer m.Close()
+
+	conn, err := net.Dial("tcp", fmt.Sprintf(":%d", m.Port()))
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	requests := []struct {
+		req  string
+		want string
+	}{
+		{"set a 0 0 4\r\naaaa\r\n", string(resultStored)},
+		{"set b 0 0 4\r\nbbbb\r\n", string(resultStored)},
+		{"set c 0 0 4\r\ncccc\r\n", string(resultServerErrOutOfMemory)},
+		{"ms c 4\r\ncccc\r\n", string(resultServerErrOutOfMemory)},
+		{"set a 0 0 4\r\nAAAA\r\n", string(resultStored)},
+		{"append a 0 0 1\r\na\r\n", string(resultServerErrOutOfMemory)},
+		{"get a\r\n", "VALUE a 0 4\r\nAAAA\r\nEND\r\n"},
+		{"set a 0 0 5\r\naaaaa\r\n", string(resultServerErrOutOfMemory)},
+		{"get a b\r\n", "VALUE b 0 4\r\nbbbb\r\nEND\r\n"},
+	}
+	for _, r := range requests {
+		if err := request(conn, r.req, r.want); err != nil {
+			t.Errorf("%q: %v", r.req, err)
+			return
+		}
+	}
+
+	items, err := readStats(conn, "stats items\r\n")
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	if items["items:1:outofmemory"] != "4" || items["items:1:evicted"] != "0" {
+		t.Errorf("unexpected stats: %v", items)
+	}
+}
+
+func TestCacheMemlimit(t *testing.T) {
+	m, err := Run(&Config{}, WithClock(clk))
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	defer m.Close()
+
+	conn, err := net.Dial("tcp", fmt.Sprintf(":%d", m.Port()))
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	requests := []struct {
+		req  string
+		want string
+	}{
+		{"cache_memlimit 7\r\n", string(resultMemlimitTooSmall)},
+		{"cache_memlimit abc\r\n", string(resultErr)},
+		{"cache_memlimit 8\r\n", string(resultOK)},
+		{"cache_memlimit 16 noreply\r\n", ""},
+	}
+	for _, r := range requests {
+		if err := request(conn, r.req, r.want); err != nil {
+			t.Errorf("%q: %v", r.req, err)
+			return
+		}
+	}
+
+	settings, err := readStats(conn, "stats settings\r\n")
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	if settings["maxbytes"] != "16777216" || settings["evictions"] != "on" {
+		t.Errorf("unexpected settings: %v", settings)
+	}
+
+	// Lowering the limit evicts the items which no longer fit.
+	m.setMemoryLimit(lruTestItemSize)
+	for _, r := range []struct {
+		req  string
+		want string
+	}{
+		{"set a 0 0 4\r\naaaa\r\n", string(resultStored)},
+		{"set b 0 0 4\r\nbbbb\r\n", string(resultStored)},
+		{"get a b\r\n", "VALUE b 0 4\r\nbbbb\r\nEND\r\n"},
+	} {
+		if err := request(conn, r.req, r.want); err != nil {
+			t.Errorf("%q: %v", r.req, err)
+			return
+		}
+	}
+}
+
+func TestSegmentedLRU(t *testing.T) {
+	m, err := Run(&Config{}, WithClock(clk), WithSegmentedLRU())
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	defer m.Close()
+
+	conn, err := net.Dial("tcp", fmt.Sprintf(":%d", m.Port()))
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	requests := []struct {
+		req  string
+		want string
+	}{
+		{"set a 0 0 4\r\naaaa\r\n", string(resultStored)},
+		{"set b 0 0 4\r\nbbbb\r\n", string(resultStored)},
+		{"set c 0 0 4\r\ncccc\r\n", string(resultStored)},
+		{"get a\r\n", "VALUE a 0 4\r\naaaa\r\nEND\r\n"},
+		{"get a\r\n", "VALUE a 0 4\r\naaaa\r\nEND\r\n"},
+	}
+	for _, r := range requests {
+		if err := request(conn, r.req, r.want); err != nil {
+			t.Errorf("%q: %v", r.req, err)
+			return
+		}
+	}
+
+	items, err := readStats(conn, "stats items\r\n")
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	if items["items:1:number_hot"] != "3" || items["items:1:number_cold"] != "0" {
+		t.Errorf("unexpected stats: %v", items)
+		return
+	}
+
+	// The LRU maintainer rescues the active item to WARM, and moves the others to COLD.
+	clk.Add(lruMaintainerInterval)
+	var stats map[string]string
+	for i := 0; i < 100; i++ {
+		if stats, err = readStats(conn, "stats\r\n"); err != nil || stats["moves_to_cold"] == "2" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for name, value := range map[string]string{"moves_to_cold": "2", "moves_to_warm": "1", "moves_within_lru": "0"} {
+		if stats[name] != value {
+			t.Errorf("%s: want: %q, got: %q", name, value, stats[name])
+		}
+	}
+	items, err = readStats(conn, "stats items\r\n")
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	for name, value := range map[string]string{"items:1:number_hot": "0", "items:1:number_warm": "1", "items:1:number_cold": "2"} {
+		if items[name] != value {
+			t.Errorf("%s: want: %q, got: %q", name, value, items[name])
+		}
+	}
+
+	// Items are evicted from the tail of COLD, so the WARM item survives.
+	m.setMemoryLimit(2 * lruTestItemSize)
+	if err := request(conn, "get a b c\r\n", "VALUE a 0 4\r\naaaa\r\nVALUE c 0 4\r\ncccc\r\nEND\r\n"); err != nil {
+		t.Errorf("err: %v", err)
+	}
+}
@@ -0,0 +1,112 @@
+package minimemcached
+
+import (
+	"strconv"
+	"strings"
+)
+
+const (
+	// maxOpaqueLength is the maximum length of an opaque token given with the `O` flag.
+	maxOpaqueLength = 32
+)
+
+// metaFlag is a flag given to a meta command, along with its optional token.
+type metaFlag struct {
+	flag  byte
+	token string
+}
+
+// metaFlags is a list of flags given to a meta command, in the order they were given.
+type metaFlags []metaFlag
+
+// parseMetaFlags() parses flags of a meta command.
+// Only flags listed in allowed are accepted, and the tokens of flags listed in numeric must be numbers.
+// On failure, it returns the error result to write to the client.
+func parseMetaFlags(tokens []string, allowed string, numeric string) (metaFlags, []byte) {
+	flags := make(metaFlags, 0, len(tokens))
+	for _, t := range tokens {
+		if t == "" {
+			continue
+		}
+		f := metaFlag{flag: t[0], token: t[1:]}
+		if !strings.ContainsRune(allowed, rune(f.flag)) {
+			return nil, resultClientErrInvalidFlag
+		}
+		if flags.has(f.flag) {
+			return nil, resultClientErrDuplicateFlag
+		}
+		if f.flag == 'O' && len(f.token) > maxOpaqueLength {
+			return nil, resultClientErrOpaqueTooLong
+		}
+		if strings.ContainsRune(numeric, rune(f.flag)) && !isNumericToken(f.token) {
+			return nil, resultClientErrBadToken
+		}
+		flags = append(flags, f)
+	}
+	return flags, nil
+}
+
+// has() reports whether flag has been given.
+func (f metaFlags) has(flag byte) bool {
+	_, ok := f.token(flag)
+	return ok
+}
+
+// token() returns the token given with flag.
+func (f metaFlags) token(flag byte) (string, bool) {
+	for _, mf := range f {
+		if mf.flag == flag {
+			return mf.token, true
+		}
+	}
+	return "", false
+}
+
+// numericToken() returns the token given with flag as a number.
+// Numeric tokens are validated by parseMetaFlags(), so parse errors are not reported here.
+func (f metaFlags) numericToken(flag byte) (int64, bool) {
+	token, ok := f.token(flag)
+	if !ok {
+		return 0, false
+	}
+	n, _ := strconv.ParseInt(token, 10, 64)
+	return n, true
+}
+
+// unsignedToken() returns the token given with flag as an unsigned number.
+func (f metaFlags) unsignedToken(flag byte) (uint64, bool) {
+	token, ok := f.token(flag)
+	if !ok {
+		return 0, false
+	}
+	n, _ := strconv.ParseUint(token, 10, 64)
+	return n, true
+}
+
+// isNumericToken() reports whether token is a signed or an unsigned 64-bit number.
+func isNumericToken(token string) bool {
+	if _, err := strconv.ParseInt(token, 10, 64); err == nil {
+		return true
+	}
+	_, err := strconv.ParseUint(token, 10, 64)
+	return err == nil
+}
+
+// appendMetaFlag() appends a return flag of a meta response to result.
+func appendMetaFlag(result []byte, flag byte, token string) []byte {
+	result = append(result, ' ', flag)
+	return append(result, token...)
+}
+
+// appendMetaEcho() appends the `O` and `k` return flags, which are returned regardless of the result.
+func appendMetaEcho(result []byte, key string, flags metaFlags) []byte {
+	for _, f := range flags {
+		switch f.flag {
+		case 'O':
+			result = appendMetaFlag(result, 'O', f.token)
+		case 'k':
+			result = appendMetaFlag(result, 'k', key)
+		}
+	}
+	return result
+}
@@ -0,0 +1,415 @@
+package minimemcached
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+func dial(t *testing.T) net.Conn {
+	conn, err := net.Dial("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	return conn
+}
+
+func TestMetaGetHit(t *testing.T) {
+	if err := removeAllPreviousData(t); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+
+	item := &memcache.Item{
+		Key:        "testKey",
+		Value:      []byte("testValue"),
+		Flags:      7,
+		Expiration: 60,
+	}
+	if err := mc.Set(item); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+
+	conn := dial(t)
+	if err := request(conn, "mg testKey v f c t s k Oabc\r\n", "VA 9 f7 c1 t60 s9 ktestKey Oabc\r\ntestValue\r\n"); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := request(conn, "mg testKey\r\n", "HD\r\n"); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+}
+
+func TestMetaGetMiss(t *testing.T) {
+	if err := removeAllPreviousData(t); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+
+	conn := dial(t)
+	if err := request(conn, "mg testKey v Oabc k\r\n", "EN Oabc ktestKey\r\n"); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := request(conn, "mg testKey v q\r\nmg testKey v\r\n", "EN\r\n"); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+}
+
+func TestMetaGetHitBeforeAndLastAccess(t *testing.T) {
+	if err := removeAllPreviousData(t); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+
+	if err := mc.Set(&memcache.Item{Key: "testKey", Value: []byte("testValue")}); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+
+	conn := dial(t)
+	clk.Add(5 * time.Second)
+	if err := request(conn, "mg testKey h l u\r\n", "HD h0 l5\r\n"); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := request(conn, "mg testKey h l\r\n", "HD h0 l5\r\n"); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	clk.Add(2 * time.Second)
+	if err := request(conn, "mg testKey h l\r\n", "HD h1 l2\r\n"); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+}
+
+func TestMetaGetTouch(t *testing.T) {
+	if err := removeAllPreviousData(t); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+
+	if err := mc.Set(&memcache.Item{Key: "testKey", Value: []byte("testValue"), Expiration: 2}); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+
+	conn := dial(t)
+	if err := request(conn, "mg testKey T60 t\r\n", "HD t60\r\n"); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	clk.Add(3 * time.Second)
+	if err := request(conn, "mg testKey t\r\n", "HD t57\r\n"); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+}
+
+func TestMetaGetVivifyAndRecache(t *testing.T) {
+	if err := removeAllPreviousData(t); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+
+	conn := dial(t)
+	if err := request(conn, "mg testKey v N30 t\r\n", "VA 0 t30 W\r\n\r\n"); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := request(conn, "mg testKey v N30\r\n", "VA 0 Z\r\n\r\n"); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := request(conn, "ms testKey 1 T30\r\nA\r\n", "HD\r\n"); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := request(conn, "mg testKey R10\r\n", "HD\r\n"); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	clk.Add(25 * time.Second)
+	if err := request(conn, "mg testKey R10\r\n", "HD W\r\n"); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := request(conn, "mg testKey R10\r\n", "HD Z\r\n"); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+}
+
+func TestMetaGetInvalidFlag(t *testing.T) {
+	if err := removeAllPreviousData(t); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+
+	conn := dial(t)
+	if err := request(conn, "mg testKey v x\r\n", string(resultClientErrInvalidFlag)); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := request(conn, "mg testKey v v\r\n", string(resultClientErrDuplicateFlag)); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := request(conn, "mg testKey Tabc\r\n", string(resultClientErrBadToken)); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+}
+
+func TestMetaSet(t *testing.T) {
+	if err := removeAllPreviousData(t); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+
+	conn := dial(t)
+	if err := request(conn, "ms testKey 4 F5 T60 c k Oabc\r\n1\r\n2\r\n", "HD c1 ktestKey Oabc\r\n"); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := request(conn, "mg testKey v f t\r\n", "VA 4 f5 t60\r\n1\r\n2\r\n"); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := request(conn, "ms testKey 1 q\r\nA\r\nmg testKey v\r\n", "VA 1\r\nA\r\n"); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+}
+
+func TestMetaSetModes(t *testing.T) {
+	if err := removeAllPreviousData(t); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+
+	conn := dial(t)
+	requests := []struct {
+		req  string
+		want string
+	}{
+		{"ms testKey 1 MR\r\nA\r\n", "NS\r\n"},
+		{"ms testKey 1 MA\r\nA\r\n", "NS\r\n"},
+		{"ms testKey 1 ME\r\nA\r\n", "HD\r\n"},
+		{"ms testKey 1 ME\r\nB\r\n", "NS\r\n"},
+		{"ms testKey 1 MA\r\nC\r\n", "HD\r\n"},
+		{"ms testKey 1 MP\r\nD\r\n", "HD\r\n"},
+		{"mg testKey v\r\n", "VA 3\r\nDAC\r\n"},
+		{"ms testKey 1 MR\r\nE\r\n", "HD\r\n"},
+		{"ms testKey 1 Ms\r\nF\r\n", "HD\r\n"},
+		{"mg testKey v\r\n", "VA 1\r\nF\r\n"},
+		{"ms testKey 1 MX\r\nG\r\n", string(resultClientErrInvalidMode)},
+	}
+	for _, r := range requests {
+		if err := request(conn, r.req, r.want); err != nil {
+			t.Errorf("%s: %v", r.req, err)
+			return
+		}
+	}
+}
+
+func TestMetaSetCAS(t *testing.T) {
+	if err := removeAllPreviousData(t); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+
+	conn := dial(t)
+	requests := []struct {
+		req  string
+		want string
+	}{
+		{"ms testKey 1 C1\r\nA\r\n", "NF\r\n"},
+		{"ms testKey 1 c\r\nA\r\n", "HD c1\r\n"},
+		{"ms testKey 1 C2\r\nB\r\n", "EX\r\n"},
+		{"ms testKey 1 C1 c\r\nB\r\n", "HD c2\r\n"},
+		{"ms testKey 1 C1 I\r\nC\r\n", "HD\r\n"},
+		{"mg testKey v c\r\n", "VA 1 c3 X W\r\nC\r\n"},
+		{"ms testKey 1 E100 c\r\nD\r\n", "HD c100\r\n"},
+		{"mg testKey c\r\n", "HD c100\r\n"},
+	}
+	for _, r := range requests {
+		if err := request(conn, r.req, r.want); err != nil {
+			t.Errorf("%s: %v", r.req, err)
+			return
+		}
+	}
+}
+
+func TestMetaDelete(t *testing.T) {
+	if err := removeAllPreviousData(t); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+
+	conn := dial(t)
+	requests := []struct {
+		req  string
+		want string
+	}{
+		{"md testKey Oabc k\r\n", "NF Oabc ktestKey\r\n"},
+		{"md testKey q\r\nmg testKey\r\n", "EN\r\n"},
+		{"ms testKey 1\r\nA\r\n", "HD\r\n"},
+		{"md testKey C2\r\n", "EX\r\n"},
+		{"md testKey C1\r\n", "HD\r\n"},
+		{"mg testKey\r\n", "EN\r\n"},
+		{"ms testKey 1 T60\r\nA\r\n", "HD\r\n"},
+		{"md testKey I T30\r\n", "HD\r\n"},
+		{"mg testKey v c t\r\n", "VA 1 c3 t30 X W\r\nA\r\n"},
+		{"md testKey q\r\nmg testKey\r\n", "EN\r\n"},
+	}
+	for _, r := range requests {
+		if err := request(conn, r.req, r.want); err != nil {
+			t.Errorf("%s: %v", r.req, err)
+			return
+		}
+	}
+}
+
+func TestMetaArithmetic(t *testing.T) {
+	if err := removeAllPreviousData(t); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+
+	conn := dial(t)
+	requests := []struct {
+		req  string
+		want string
+	}{
+		{"ma testKey\r\n", "NF\r\n"},
+		{"ma testKey q\r\nmg testKey\r\n", "EN\r\n"},
+		{"ma testKey N60 J10 v t\r\n", "VA 2 t60\r\n10\r\n"},
+		{"ma testKey v\r\n", "VA 2\r\n11\r\n"},
+		{"ma testKey D5 MD v c\r\n", "VA 1 c3\r\n6\r\n"},
+		{"ma testKey D10 M- v\r\n", "VA 1\r\n0\r\n"},
+		{"ma testKey D18446744073709551615 M+\r\n", "HD\r\n"},
+		{"ma testKey D2 MI v\r\n", "VA 1\r\n1\r\n"},
+		{"ma testKey C1 v\r\n", "EX\r\n"},
+		{"ma testKey q\r\nmg testKey v\r\n", "VA 1\r\n2\r\n"},
+		{"ma testKey MX\r\n", string(resultClientErrInvalidArithmeticMode)},
+		{"ms testKey 1\r\nA\r\n", "HD\r\n"},
+		{"ma testKey\r\n", string(resultClientErrIncrDecrNonNumericValue)},
+	}
+	for _, r := range requests {
+		if err := request(conn, r.req, r.want); err != nil {
+			t.Errorf("%s: %v", r.req, err)
+			return
+		}
+	}
+}
+
+func TestMetaNoOp(t *testing.T) {
+	if err := removeAllPreviousData(t); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+
+	conn := dial(t)
+	if err := request(conn, "mn\r\n", "MN\r\n"); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+}
+
+func TestMetaQuietPipeline(t *testing.T) {
+	if err := removeAllPreviousData(t); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+
+	conn := dial(t)
+	requests := "ms key1 6 q\r\nvalue1\r\n" +
+		"ms key2 6 q ME\r\nvalue2\r\n" +
+		"ms key2 6 q ME Oset\r\nvalue2\r\n" +
+		"mg key1 v q k\r\n" +
+		"mg key3 v q k\r\n" +
+		"mg key2 v q k\r\n" +
+		"ma key1 q\r\n" +
+		"md key3 q\r\n" +
+		"md key2 q\r\n" +
+		"mg key2 v q k\r\n" +
+		"mn\r\n"
+	want := "NS Oset\r\n" +
+		"VA 6 kkey1\r\nvalue1\r\n" +
+		"VA 6 kkey2\r\nvalue2\r\n" +
+		string(resultClientErrIncrDecrNonNumericValue) +
+		"MN\r\n"
+	if err := request(conn, requests, want); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+}
+
+func TestMetaDebug(t *testing.T) {
+	if err := removeAllPreviousData(t); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+
+	if err := mc.Set(&memcache.Item{Key: "testKey", Value: []byte("testValue"), Expiration: 60}); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+
+	conn := dial(t)
+	clk.Add(10 * time.Second)
+	if err := request(conn, "me testKey\r\n", "ME testKey exp=50 la=10 cas=1 fetch=no cls=1 size=75\r\n"); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := request(conn, "mg testKey\r\nme testKey\r\n", "HD\r\nME testKey exp=50 la=0 cas=1 fetch=yes cls=1 size=75\r\n"); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := request(conn, "me wrongKey\r\n", "EN\r\n"); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+}
+
+func TestMetaStaleWhileRevalidate(t *testing.T) {
+	if err := removeAllPreviousData(t); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+
+	winner, other := dial(t), dial(t)
+	requests := []struct {
+		conn net.Conn
+		req  string
+		want string
+	}{
+		{winner, "ms testKey 2 T60\r\nv1\r\n", "HD\r\n"},
+		{winner, "md testKey I T30\r\n", "HD\r\n"},
+		{winner, "mg testKey v c t\r\n", "VA 2 c2 t30 X W\r\nv1\r\n"},
+		{other, "mg testKey v c\r\n", "VA 2 c2 Z X\r\nv1\r\n"},
+		{other, "ms testKey 2 C1 I\r\nv0\r\n", "HD\r\n"},
+		{other, "mg testKey v\r\n", "VA 2 Z X\r\nv0\r\n"},
+		{winner, "ms testKey 2 C2 T60\r\nv2\r\n", "EX\r\n"},
+		{winner, "mg testKey c\r\n", "HD c3 Z X\r\n"},
+		{winner, "ms testKey 2 C3 T60\r\nv2\r\n", "HD\r\n"},
+		{other, "mg testKey v\r\n", "VA 2\r\nv2\r\n"},
+	}
+	for _, r := range requests {
+		if err := request(r.conn, r.req, r.want); err != nil {
+			t.Errorf("%s: %v", r.req, err)
+			return
+		}
+	}
+}
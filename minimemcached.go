@@ -3,13 +3,19 @@ package minimemcached
 import (
 	"bufio"
 	gobytes "bytes"
+	"container/list"
 	"errors"
 	"io"
+	"math"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/benbjohnson/clock"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
@@ -17,6 +23,16 @@ const (
 	Version = "1.1.0"
 )
 
+var (
+	errBadDataChunk   = errors.New("bad data chunk")
+	errBadCommandLine = errors.New("bad command line format")
+	errObjectTooLarge = errors.New("object too large for cache")
+)
+
+// verbosityLevels are the log levels set by the `verbosity` command, indexed by verbosity.
+// Verbosities above the last one use the last level.
+var verbosityLevels = []zerolog.Level{zerolog.InfoLevel, zerolog.DebugLevel, zerolog.TraceLevel}
+
 type MiniMemcached struct {
 	*server
 	mu       sync.RWMutex
@@ -24,6 +40,69 @@ type MiniMemcached struct {
 	casToken uint64
 	port     uint16
 	clock    clock.Clock
+	// lrus are the lists of the keys of the items in each LRU segment, from the most recently used one.
+	lrus [numLRUSegments]*list.List
+	// lruBytes are the numbers of bytes used to store the items in each LRU segment.
+	lruBytes [numLRUSegments]int64
+	// lruSegmented is true when the LRU is split into HOT, WARM and COLD segments.
+	lruSegmented bool
+	// lruMaintainer ticks when the LRU maintainer is due to run.
+	lruMaintainer *clock.Ticker
+	// lruMaintainerDone is closed to stop the LRU maintainer.
+	lruMaintainerDone chan struct{}
+	// bytes is the number of bytes used to store the items.
+	bytes int64
+	// maxBytes is the number of bytes which may be used to store the items. 0 means no limit.
+	maxBytes int64
+	// maxItemSize is the largest size of an item.
+	maxItemSize int
+	// evictionsDisabled is true when storage commands fail instead of evicting items.
+	evictionsDisabled bool
+	// startedAt is the time when mini-memcached has been created.
+	startedAt time.Time
+	// saslCredentials maps usernames to passwords for SASL authentication.
+	saslCredentials map[string]string
+	// asciiCredentials maps usernames to passwords for ASCII protocol authentication.
+	asciiCredentials map[string]string
+	// counters are the statistics reported by the `stats` command.
+	counters counters
+	// slabClassCounters are the statistics reported by the `stats items` command, indexed by slab class id.
+	slabClassCounters map[int]*slabClassCounters
+	// detailEnabled is true when the statistics of each key prefix are collected.
+	detailEnabled bool
+	// prefixDelimiter is the delimiter between key prefixes and ids.
+	prefixDelimiter byte
+	// prefixStats are the statistics reported by the `stats detail dump` command, indexed by key prefix.
+	prefixStats map[string]*PrefixStats
+	// verbosity is the verbosity set by the `verbosity` command. It is accessed atomically.
+	verbosity uint32
+	// shutdownEnabled is true when clients may stop mini-memcached with the `shutdown` command.
+	shutdownEnabled bool
+	// draining is true when mini-memcached closes once every client connection has been closed.
+	draining bool
+	// flushTimer removes every item when a delayed flush is due.
+	flushTimer *clock.Timer
+	// slabsEnabled is true when the memory is accounted in the slab pages assigned to each slab class.
+	slabsEnabled bool
+	// growthFactor is the growth factor of slab chunk sizes.
+	growthFactor float64
+	// chunkSize is the space for the key, value and flags of the smallest slab chunk.
+	chunkSize int
+	// slabClasses are the chunk sizes of the slab classes, indexed by slab class id.
+	// Slab class ids start from 1, as in memcached.
+	slabClasses []int
+	// slabs are the memory of the slab classes, indexed by slab class id.
+	slabs []slabMemory
+	// slabPagesMalloced is the number of slab pages allocated, including the ones in the global page pool.
+	slabPagesMalloced int
+	// slabGlobalPages is the number of slab pages in the global page pool, assigned to no slab class.
+	slabGlobalPages int
+	// slabAutomove is the mode of the slab automover.
+	slabAutomove slabAutomove
+	// conns are the client connections being served, indexed by connection id.
+	conns map[int]*connection
+	// lastConnID is the id of the latest registered client connection.
+	lastConnID int
 }
 
 // Config contains minimum attributes to run mini-memcached.
@@ -32,6 +111,19 @@ type Config struct {
 	// Port is the port number where mini-memcached will start.
 	// When given 0, mini-memcached will start running on a random available port.
 	Port uint16
+	// SASLCredentials maps usernames to passwords. When given, clients must authenticate
+	// with SASL PLAIN, and only the binary protocol is served, as memcached does with `-S`.
+	SASLCredentials map[string]string
+	// MaxBytes is the number of bytes mini-memcached may use to store items, as memcached's `-m`.
+	// When given 0, the memory is not limited.
+	MaxBytes int64
+	// DisableEvictions makes storage commands fail with an out of memory error instead of evicting
+	// items when MaxBytes is reached, as memcached does with `-M`.
+	DisableEvictions bool
+	// MaxItemSize is the largest size of an item, including its key and the overhead memcached stores
+	// along with it, as memcached's `-I`. Storage commands fail with an object too large error beyond it.
+	// When given 0, it is 1MB.
+	MaxItemSize int
 }
 
 // item is an object stored in mini-memcached.
@@ -41,15 +133,57 @@ type item struct {
 	// flags is a 32-bit unsigned integer that mini-memcached stores with the data
 	// provided by the user.
 	flags uint32
-	// expiration is the expiration time in seconds.
-	// 0 means no delay. IF expiration is more than 30 days, mini-memcached
-	// uses it as a UNIX timestamp for expiration.
-	expiration int32
+	// expiresAt is UNIX timestamp of the time when item expires, computed by deadline().
+	// 0 means item never expires.
+	expiresAt int64
 	// casToken is a unique unsigned 64-bit value of an existing item.
 	casToken uint64
-	// createdAt is UNIX timestamp of the time when item has been created.
-	// It is used for invalidations along with expiration.
-	createdAt int64
+	// lastAccessedAt is UNIX timestamp of the time when item has been stored or fetched last.
+	lastAccessedAt int64
+	// fetched is true when item has been fetched since it has been stored.
+	fetched bool
+	// stale is true when item has been invalidated by a meta command, but is still served.
+	stale bool
+	// winTokenSent is true when a client has been told to recache item with the `W` flag.
+	// The other clients get the `Z` flag until item is recached.
+	winTokenSent bool
+	// active is true when item has been fetched again since it has been fetched first.
+	// Active items are moved to WARM by the LRU maintainer.
+	active bool
+	// segment is the LRU segment where item lives.
+	segment lruSegment
+	// element is the element of item in the list of its LRU segment.
+	element *list.Element
+}
+
+// deadline() returns UNIX timestamp of the time when an item stored at now with exptime expires,
+// with the rules of memcached: 0 means never, exptime up to 30 days is relative to now, a larger one
+// is UNIX timestamp, and a negative one means the item has already expired.
+// Every command setting exptime of an item uses it.
+func deadline(exptime int64, now int64) int64 {
+	switch {
+	case exptime == 0:
+		return 0
+	case exptime < 0:
+		return now
+	case exptime > int64(ttlUnixTimestamp):
+		return exptime
+	default:
+		return now + exptime
+	}
+}
+
+// expired() reports whether item has expired at now.
+func (i *item) expired(now int64) bool {
+	return i.expiresAt != 0 && now >= i.expiresAt
+}
+
+// access() records that item has been fetched at now.
+// An item fetched more than once becomes active.
+func (i *item) access(now int64) {
+	i.lastAccessedAt = now
+	i.active = i.fetched
+	i.fetched = true
 }
 
 type Option func(m *MiniMemcached)
@@ -57,14 +191,22 @@ type Option func(m *MiniMemcached)
 // newMiniMemcached returns a newMiniMemcached, non-started, MiniMemcached object.
 func newMiniMemcached(opts ...Option) *MiniMemcached {
 	m := MiniMemcached{
-		items:    map[string]*item{},
-		casToken: 0,
-		clock:    clock.New(),
+		items:             map[string]*item{},
+		lrus:              newLRUs(),
+		casToken:          0,
+		clock:             clock.New(),
+		slabClassCounters: map[int]*slabClassCounters{},
+		conns:             map[int]*connection{},
+		prefixDelimiter:   defaultPrefixDelimiter,
+		prefixStats:       map[string]*PrefixStats{},
+		growthFactor:      defaultGrowthFactor,
+		chunkSize:         defaultChunkSize,
 	}
 
 	for _, opt := range opts {
 		opt(&m)
 	}
+	m.startedAt = m.clock.Now()
 
 	return &m
 }
@@ -76,20 +218,65 @@ func WithClock(clk clock.Clock) Option {
 	}
 }
 
+// WithASCIIAuth requires ASCII protocol clients to authenticate, as memcached does with `-Y`.
+// Clients authenticate by sending a `set` request whose data block is `<username> <password>`,
+// with any key, flags and exptime. Binary protocol clients are disconnected.
+func WithASCIIAuth(credentials map[string]string) Option {
+	return func(m *MiniMemcached) {
+		m.asciiCredentials = credentials
+	}
+}
+
+// WithShutdownEnabled allows clients to stop mini-memcached with the `shutdown` command,
+// as memcached does with `-A`.
+func WithShutdownEnabled() Option {
+	return func(m *MiniMemcached) {
+		m.shutdownEnabled = true
+	}
+}
+
 // Run creates and starts a MiniMemcached server on a random, available port.
 // Close with Close().
 func Run(cfg *Config, opts ...Option) (*MiniMemcached, error) {
 	m := newMiniMemcached(opts...)
+	if err := m.initSlabs(); err != nil {
+		return nil, err
+	}
+	m.saslCredentials = cfg.SASLCredentials
+	m.maxBytes = cfg.MaxBytes
+	m.evictionsDisabled = cfg.DisableEvictions
+	m.maxItemSize = defaultMaxItemSize
+	if cfg.MaxItemSize != 0 {
+		m.maxItemSize = cfg.MaxItemSize
+	}
 	return m, m.start(cfg.Port)
 }
 
-// Close closes mini-memcached server and clears all objects stored.
+// Close closes mini-memcached server and every client connection, and clears all objects stored.
 func (m *MiniMemcached) Close() {
 	m.mu.Lock()
-	m.items = nil
+	m.unlinkAll()
+	m.stopLRUMaintainer()
+	if m.flushTimer != nil {
+		m.flushTimer.Stop()
+	}
 	m.close()
+	m.draining = false
+	for _, c := range m.conns {
+		_ = c.conn.Close()
+	}
 	m.mu.Unlock()
-	log.Info().Msg("closed mini-memcached.")
+	m.logger().Info().Msg("closed mini-memcached.")
+}
+
+// logger() returns the logger of mini-memcached, at the level set by the `verbosity` command.
+func (m *MiniMemcached) logger() *zerolog.Logger {
+	verbosity := int(atomic.LoadUint32(&m.verbosity))
+	if verbosity >= len(verbosityLevels) {
+		verbosity = len(verbosityLevels) - 1
+	}
+	logger := log.Logger.Level(verbosityLevels[verbosity])
+	return &logger
 }
 
 func (m *MiniMemcached) Port() uint16 {
@@ -110,6 +297,9 @@ func (m *MiniMemcached) start(port uint16) error {
 
 	m.port = uint16(tcpAddr.Port)
 	m.server = s
+	if m.lruSegmented || m.slabsEnabled {
+		m.startLRUMaintainer()
+	}
 	m.newServer()
 	return nil
 }
@@ -126,119 +316,319 @@ func (m *MiniMemcached) serve() {
 		if err != nil {
 			return
 		}
-		go m.serveConn(conn)
+		c, ok := m.register(conn)
+		if !ok {
+			_, _ = conn.Write(resultErrTooManyConns)
+			_ = conn.Close()
+			continue
+		}
+		go m.serveConn(c)
 	}
 }
 
-func (m *MiniMemcached) serveConn(conn net.Conn) {
+// serveConn() serves requests from a single client connection.
+// Clients speaking the binary protocol are told apart by the magic byte of their first request.
+// The reader and writer live as long as the connection does, so that pipelined requests
+// are served in order and replies are flushed once every buffered request has been served.
+// c is unregistered once the connection has been closed.
+func (m *MiniMemcached) serveConn(c *connection) {
+	defer m.unregister(c)
+	defer c.conn.Close()
+	reader := bufio.NewReader(c.conn)
+	writer := bufio.NewWriter(c.conn)
+	if magic, err := reader.Peek(1); err == nil && magic[0] == binaryReqMagic {
+		// The binary protocol is turned off along with ASCII authentication, as memcached does with `-Y`.
+		if m.asciiCredentials == nil {
+			m.serveBinary(c, reader, writer)
+		}
+		return
+	}
+	if m.saslCredentials != nil {
+		return
+	}
+
+	authenticated := m.asciiCredentials == nil
 	for {
-		reader := bufio.NewReader(conn)
+		m.setConnState(c, connWaiting)
+		if reader.Buffered() == 0 {
+			if err := writer.Flush(); err != nil {
+				return
+			}
+		}
+
 		req, err := reader.ReadString('\n')
-		if errors.Is(err, io.EOF) {
+		if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
 			break
 		}
 
 		if err != nil {
-			log.Err(err).Msgf("err reading string: %v", err)
+			m.logger().Err(err).Msgf("err reading string: %v", err)
 			return
 		}
+		m.setConnState(c, connParseCmd)
 		req = strings.TrimSuffix(req, "\r\n")
+		m.logger().Trace().Msgf("<%d %s", c.id, req)
 		cmdLine := strings.Split(req, " ")
 		cmd := strings.ToLower(cmdLine[0])
+		if !authenticated {
+			if cmd != setCmd {
+				_, _ = writer.Write(resultClientErrUnauthenticated)
+				continue
+			}
+			value, err := m.readDataBlock(reader, cmdLine, 4)
+			if err != nil {
+				if !writeDataBlockError(err, writer) {
+					return
+				}
+				continue
+			}
+			authenticated = m.authenticate(value, writer)
+			continue
+		}
+
 		switch cmd {
 		case getCmd:
-			handleGet(m, cmdLine, conn)
+			handleGet(m, cmdLine, writer)
 		case getsCmd:
-			handleGets(m, cmdLine, conn)
+			handleGets(m, cmdLine, writer)
+		case gatCmd:
+			handleGat(m, cmdLine, false, writer)
+		case gatsCmd:
+			handleGat(m, cmdLine, true, writer)
+		case metaGetCmd:
+			handleMetaGet(m, cmdLine, writer)
+		case metaSetCmd:
+			value, err := m.readDataBlock(reader, cmdLine, 2)
+			if err != nil {
+				if !m.rejectDataBlock(err, cmdLine, writer) {
+					return
+				}
+				continue
+			}
+			handleMetaSet(m, cmdLine, value, writer)
+		case metaDeleteCmd:
+			handleMetaDelete(m, cmdLine, writer)
+		case metaArithmeticCmd:
+			handleMetaArithmetic(m, cmdLine, writer)
+		case metaNoOpCmd:
+			handleMetaNoOp(m, writer)
+		case metaDebugCmd:
+			handleMetaDebug(m, cmdLine, writer)
 		case setCmd:
-			value, err := reader.ReadBytes('\n')
+			value, err := m.readDataBlock(reader, cmdLine, 4)
 			if err != nil {
-				handleErr(conn)
+				if !m.rejectDataBlock(err, cmdLine, writer) {
+					return
+				}
+				continue
 			}
-
-			value = gobytes.TrimSuffix(value, crlf)
-			handleSet(m, cmdLine, value, conn)
+			handleSet(m, cmdLine, value, writer)
 		case addCmd:
-			value, err := reader.ReadBytes('\n')
+			value, err := m.readDataBlock(reader, cmdLine, 4)
 			if err != nil {
-				handleErr(conn)
+				if !m.rejectDataBlock(err, cmdLine, writer) {
+					return
+				}
+				continue
 			}
-
-			value = gobytes.TrimSuffix(value, crlf)
-			handleAdd(m, cmdLine, value, conn)
+			handleAdd(m, cmdLine, value, writer)
 		case replaceCmd:
-			value, err := reader.ReadBytes('\n')
+			value, err := m.readDataBlock(reader, cmdLine, 4)
 			if err != nil {
-				handleErr(conn)
+				if !m.rejectDataBlock(err, cmdLine, writer) {
+					return
+				}
+				continue
 			}
-
-			value = gobytes.TrimSuffix(value, crlf)
-			handleReplace(m, cmdLine, value, conn)
+			handleReplace(m, cmdLine, value, writer)
 		case appendCmd:
-			value, err := reader.ReadBytes('\n')
+			value, err := m.readDataBlock(reader, cmdLine, 4)
 			if err != nil {
-				handleErr(conn)
+				if !m.rejectDataBlock(err, cmdLine, writer) {
+					return
+				}
+				continue
 			}
-
-			value = gobytes.TrimSuffix(value, crlf)
-			handleAppend(m, cmdLine, value, conn)
+			handleAppend(m, cmdLine, value, writer)
 		case prependCmd:
-			value, err := reader.ReadBytes('\n')
+			value, err := m.readDataBlock(reader, cmdLine, 4)
 			if err != nil {
-				handleErr(conn)
+				if !m.rejectDataBlock(err, cmdLine, writer) {
+					return
+				}
+				continue
 			}
-
-			value = gobytes.TrimSuffix(value, crlf)
-			handlePrepend(m, cmdLine, value, conn)
+			handlePrepend(m, cmdLine, value, writer)
 		case deleteCmd:
-			handleDelete(m, cmdLine, conn)
+			handleDelete(m, cmdLine, writer)
 		case incrCmd:
-			handleIncr(m, cmdLine, conn)
+			handleIncr(m, cmdLine, writer)
 		case decrCmd:
-			handleDecr(m, cmdLine, conn)
+			handleDecr(m, cmdLine, writer)
 		case touchCmd:
-			handleTouch(m, cmdLine, conn)
+			handleTouch(m, cmdLine, writer)
 		case flushAllCmd:
-			handleFlushAll(m, conn)
+			handleFlushAll(m, cmdLine, writer)
 		case casCmd:
-			value, err := reader.ReadBytes('\n')
+			value, err := m.readDataBlock(reader, cmdLine, 4)
 			if err != nil {
-				handleErr(conn)
+				if !m.rejectDataBlock(err, cmdLine, writer) {
+					return
+				}
+				continue
 			}
-
-			value = gobytes.TrimSuffix(value, crlf)
-			handleCas(m, cmdLine, value, conn)
+			handleCas(m, cmdLine, value, writer)
 		case versionCmd:
-			handleVersion(m, conn)
+			handleVersion(m, writer)
+		case verbosityCmd:
+			handleVerbosity(m, cmdLine, writer)
+		case statsCmd:
+			handleStats(m, cmdLine, writer)
+		case lruCrawlerCmd:
+			handleLRUCrawler(m, cmdLine, writer)
+		case cacheMemlimitCmd:
+			handleCacheMemlimit(m, cmdLine, writer)
+		case slabsCmd:
+			handleSlabs(m, cmdLine, writer)
+		case quitCmd:
+			_ = writer.Flush()
+			return
+		case shutdownCmd:
+			if handleShutdown(m, cmdLine, writer) {
+				_ = writer.Flush()
+				return
+			}
 		default:
-			handleErr(conn)
+			handleErr(writer)
 		}
 	}
 }
 
-// invalidate() invalidates objects by its expiration value.
-func (m *MiniMemcached) invalidate(key string) {
+// authenticate() authenticates an ASCII protocol client with the `<username> <password>` credentials
+// it has sent, and reports whether the client has been authenticated.
+func (m *MiniMemcached) authenticate(credentials []byte, w io.Writer) bool {
+	userAndPassword := strings.SplitN(string(credentials), " ", 2)
+	if len(userAndPassword) == 2 {
+		if password, ok := m.asciiCredentials[userAndPassword[0]]; ok && password == userAndPassword[1] {
+			_, _ = w.Write(resultStored)
+			return true
+		}
+	}
+	_, _ = w.Write(resultClientErrAuthFailure)
+	return false
+}
+
+// readDataBlock() reads the data block of a storage command. It reads exactly the number of bytes
+// declared in cmdLine, followed by a mandatory "\r\n" trailer, so values may contain any byte.
+// If the declared size cannot be determined, it returns a nil value and leaves it to the handler
+// to reject the command line. A size out of range is rejected before anything is read, and a block
+// too large for an item under the key of cmdLine is discarded without being buffered, as memcached does.
+func (m *MiniMemcached) readDataBlock(reader *bufio.Reader, cmdLine []string, sizeIndex int) ([]byte, error) {
+	if len(cmdLine) <= sizeIndex {
+		return nil, nil
+	}
+	bytes, err := strconv.ParseInt(cmdLine[sizeIndex], 10, 64)
+	if err != nil {
+		return nil, nil
+	}
+	if bytes < 0 || bytes > math.MaxInt32-int64(len(crlf)) {
+		return nil, errBadCommandLine
+	}
+	if bytes > int64(m.maxItemSize-(&item{}).size(cmdLine[1])) {
+		if _, err := io.CopyN(io.Discard, reader, bytes+int64(len(crlf))); err != nil {
+			return nil, err
+		}
+		return nil, errObjectTooLarge
+	}
+
+	block := make([]byte, bytes+int64(len(crlf)))
+	if _, err := io.ReadFull(reader, block); err != nil {
+		return nil, err
+	}
+	if !gobytes.HasSuffix(block, crlf) {
+		return nil, errBadDataChunk
+	}
+	return block[:bytes], nil
+}
+
+// rejectDataBlock() replies to a data block which readDataBlock() has rejected with err, and reports whether
+// the connection may still be served. A `set` too large for the cache removes the item under its key,
+// as store() does. The reply to a storage command with `noreply` is discarded, while `ms` errors are
+// always replied, as memcached does.
+func (m *MiniMemcached) rejectDataBlock(err error, cmdLine []string, w io.Writer) bool {
+	if errors.Is(err, errObjectTooLarge) && storesAsSet(cmdLine) {
+		m.mu.Lock()
+		m.unlinkTooLarge(cmdLine[1])
+		m.mu.Unlock()
+	}
+	if strings.ToLower(cmdLine[0]) != metaSetCmd {
+		_, w = parseNoreply(cmdLine, w)
+	}
+	return writeDataBlockError(err, w)
+}
+
+// storesAsSet() reports whether cmdLine is a `set`, or an `ms` in set mode. An `ms` with a CAS token
+// is not, as metaSet() stores it as a `cas`.
+func storesAsSet(cmdLine []string) bool {
+	switch strings.ToLower(cmdLine[0]) {
+	case setCmd:
+		return true
+	case metaSetCmd:
+		set := true
+		for _, token := range cmdLine[3:] {
+			switch {
+			case strings.HasPrefix(token, "M"):
+				set = set && strings.EqualFold(token[1:], "S")
+			case strings.HasPrefix(token, "C"):
+				set = false
+			}
+		}
+		return set
+	}
+	return false
+}
+
+// writeDataBlockError() writes the reply to a data block which readDataBlock() has rejected with err,
+// and reports whether the connection may still be served.
+func writeDataBlockError(err error, w io.Writer) bool {
+	switch {
+	case errors.Is(err, errBadDataChunk):
+		_, _ = w.Write(resultClientErrBadDataChunk)
+	case errors.Is(err, errBadCommandLine):
+		_, _ = w.Write(resultClientErrBadCliFormat)
+	case errors.Is(err, errObjectTooLarge):
+		_, _ = w.Write(resultServerErrObjectTooLarge)
+	default:
+		return false
+	}
+	return true
+}
+
+// invalidate() invalidates objects by its expiration value, and reports whether the object under key
+// has expired.
+func (m *MiniMemcached) invalidate(key string) bool {
 	currentTimestamp := m.clock.Now().Unix()
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	item := m.items[key]
-	if item == nil {
-		return
+	if item == nil || !item.expired(currentTimestamp) {
+		return false
 	}
-	if item.expiration == 0 {
-		return
-	}
-	if item.expiration > ttlUnixTimestamp {
-		if currentTimestamp > int64(item.expiration) {
-			delete(m.items, key)
-			return
-		}
-		return
-	}
-	if currentTimestamp-item.createdAt >= int64(item.expiration) {
-		delete(m.items, key)
-		return
+
+	m.reclaim(key)
+	return true
+}
+
+// reclaim() removes the expired item under key. The caller must hold the mutex of MiniMemcached.
+func (m *MiniMemcached) reclaim(key string) {
+	item := m.items[key]
+	classCounters := m.classCounters(m.slabClassID(item.size(key)))
+	classCounters.reclaimed++
+	if !item.fetched {
+		m.counters.expiredUnfetched++
+		classCounters.expiredUnfetched++
 	}
+	m.unlink(key)
 }
 
 // incrementCASToken() increments the CAS token.
@@ -5,15 +5,18 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"math"
 	"net"
 	"os"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/benbjohnson/clock"
 	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/rs/zerolog"
 )
 
 var (
@@ -211,6 +214,58 @@ func TestTTLInvalidation(t *testing.T) {
 	}
 }
 
+func TestExpiration(t *testing.T) {
+	c := clock.NewMock()
+	c.Set(time.Unix(1700000000, 0))
+	m, err := Run(&Config{}, WithClock(c))
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	defer m.Close()
+
+	conn, err := net.Dial("tcp", fmt.Sprintf(":%d", m.Port()))
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	now := c.Now().Unix()
+	// Each request is sent after the clock has advanced by after.
+	requests := []struct {
+		after time.Duration
+		req   string
+		want  string
+	}{
+		// A negative exptime or an absolute one in the past expires the item at once.
+		{0, "set a 0 -1 1\r\na\r\n", string(resultStored)},
+		{0, fmt.Sprintf("set b 0 %d 1\r\nb\r\n", now-10), string(resultStored)},
+		{0, "get a b\r\n", string(resultEnd)},
+		{0, fmt.Sprintf("set c 0 %d 1\r\nc\r\n", now+10), string(resultStored)},
+		{0, "set d 0 10 1\r\nd\r\n", string(resultStored)},
+		{0, "set e 0 10 1\r\ne\r\n", string(resultStored)},
+		{0, "set f 0 10 1\r\nf\r\n", string(resultStored)},
+		// Up to 30 days, exptime is relative.
+		{0, "set g 0 2592000 1\r\ng\r\n", string(resultStored)},
+		{0, "mg g t\r\n", "HD t2592000\r\n"},
+		// Touching an item sets its deadline from now.
+		{5 * time.Second, "touch d 10\r\n", string(resultTouched)},
+		{0, "gat 0 e\r\n", "VALUE e 0 1\r\ne\r\nEND\r\n"},
+		{0, "touch f -1\r\n", string(resultTouched)},
+		{0, "get f\r\n", string(resultEnd)},
+		{5 * time.Second, "get c d e\r\n", "VALUE d 0 1\r\nd\r\nVALUE e 0 1\r\ne\r\nEND\r\n"},
+		{5 * time.Second, "get d e\r\n", "VALUE e 0 1\r\ne\r\nEND\r\n"},
+	}
+	for _, r := range requests {
+		c.Add(r.after)
+		if err := request(conn, r.req, r.want); err != nil {
+			t.Errorf("%q: %v", r.req, err)
+			return
+		}
+	}
+}
+
 func TestCASToken(t *testing.T) {
 	if err := removeAllPreviousData(t); err != nil {
 		t.Errorf("err: %v", err)
@@ -459,6 +514,25 @@ func TestReplaceFailItemInvalidated(t *testing.T) {
 	}
 }
 
+// request writes a raw request to conn and validates that the server replies with want.
+func request(conn net.Conn, req string, want string) error {
+	if _, err := conn.Write([]byte(req)); err != nil {
+		return err
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		return err
+	}
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		return fmt.Errorf("err: %v, got: %q", err, got)
+	}
+	if string(got) != want {
+		return fmt.Errorf("want: %q, got: %q", want, got)
+	}
+	return nil
+}
+
 func writeAppend(key string, value []byte) error {
 	conn, err := net.Dial("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
@@ -1008,6 +1082,50 @@ func TestFlushAll(t *testing.T) {
 	}
 }
 
+func TestFlushAllDelay(t *testing.T) {
+	if err := removeAllPreviousData(t); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+
+	conn, err := net.Dial("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	requests := []struct {
+		req  string
+		want string
+	}{
+		{"set before 0 0 1\r\na\r\n", string(resultStored)},
+		{"flush_all 100\r\n", string(resultOK)},
+		{"flush_all 10 noreply\r\n", ""},
+		{"flush_all abc\r\n", string(resultClientErrBadCliFormat)},
+		{"set pending 0 0 1\r\nb\r\n", string(resultStored)},
+		{"get before pending\r\n", "VALUE before 0 1\r\na\r\nVALUE pending 0 1\r\nb\r\nEND\r\n"},
+	}
+	for _, r := range requests {
+		if err := request(conn, r.req, r.want); err != nil {
+			t.Errorf("%q: %v", r.req, err)
+			return
+		}
+	}
+
+	// The second flush_all replaces the first one, so every item stored until then is flushed after 10 seconds.
+	clk.Add(10 * time.Second)
+	if err := request(conn, "set after 0 0 1\r\nc\r\n", string(resultStored)); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	clk.Add(100 * time.Second)
+	if err := request(conn, "get before pending after\r\n", "VALUE after 0 1\r\nc\r\nEND\r\n"); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+}
+
 func TestCASSuccess(t *testing.T) {
 	if err := removeAllPreviousData(t); err != nil {
 		t.Errorf("err: %v", err)
@@ -1159,3 +1277,563 @@ func TestVersion(t *testing.T) {
 		return
 	}
 }
+
+func TestSetBinaryValue(t *testing.T) {
+	if err := removeAllPreviousData(t); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+
+	key := "testKey"
+	item := &memcache.Item{
+		Key:   key,
+		Value: []byte("line1\r\nline2\nline3\r\n\x00\xff"),
+	}
+
+	if err := mc.Set(item); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+
+	res, err := mc.Get(key)
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	if err = validateGetItemResult(item, res); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+}
+
+func TestSetFailBadDataChunk(t *testing.T) {
+	if err := removeAllPreviousData(t); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+
+	conn, err := net.Dial("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	message := fmt.Sprintf("%s %s %d %d %d", setCmd, "testKey", 0, 0, 3)
+	if _, err := conn.Write(append([]byte(message), crlf...)); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	if _, err := conn.Write([]byte("abcd\r\n")); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+
+	rw := bufio.NewReader(conn)
+	resp, err := rw.ReadSlice('\n')
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	if !bytes.Equal(resp, resultClientErrBadDataChunk) {
+		t.Errorf("want: %q, got: %q", resultClientErrBadDataChunk, resp)
+		return
+	}
+}
+
+func TestSetFailBadDataLength(t *testing.T) {
+	if err := removeAllPreviousData(t); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+
+	conn, err := net.Dial("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	// Sizes out of range are rejected before anything is allocated, and the connection is still served.
+	tooLarge := defaultMaxItemSize + 1
+	requests := []struct {
+		req  string
+		want string
+	}{
+		{"set testKey 0 0 9223372036854775806\r\n", string(resultClientErrBadCliFormat)},
+		{"set testKey 0 0 -1\r\n", string(resultClientErrBadCliFormat)},
+		{"set testKey 0 0 99999999999999999999\r\n", string(resultErr)},
+		{fmt.Sprintf("set testKey 0 0 %d\r\n%s\r\n", tooLarge, strings.Repeat("a", tooLarge)), string(resultServerErrObjectTooLarge)},
+		{"version\r\n", string(resultVersion)},
+	}
+	for i, r := range requests {
+		if err := request(conn, r.req, r.want); err != nil {
+			t.Errorf("request %d: %v", i, err)
+			return
+		}
+	}
+}
+
+func TestMaxItemSize(t *testing.T) {
+	// Items made of a 1-byte key and a 40-byte value use 100 bytes.
+	m, err := Run(&Config{MaxItemSize: 100}, WithClock(clk))
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	defer m.Close()
+
+	conn, err := net.Dial("tcp", fmt.Sprintf(":%d", m.Port()))
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	fits, tooLarge := strings.Repeat("a", 40), strings.Repeat("a", 41)
+	requests := []struct {
+		req  string
+		want string
+	}{
+		// A `set` too large for the cache removes the previous value, whether the data block or the item is too large.
+		{"set a 0 0 4\r\naaaa\r\n", string(resultStored)},
+		{"set a 0 0 41\r\n" + tooLarge + "\r\n", string(resultServerErrObjectTooLarge)},
+		{"get a\r\n", string(resultEnd)},
+		{"set a 0 0 40\r\n" + fits + "\r\n", string(resultStored)},
+		{"append a 0 0 1\r\na\r\n", string(resultServerErrObjectTooLarge)},
+		{"get a\r\n", "VALUE a 0 40\r\n" + fits + "\r\nEND\r\n"},
+		{"set a 1 0 40\r\n" + fits + "\r\n", string(resultServerErrObjectTooLarge)},
+		{"get a\r\n", string(resultEnd)},
+		// Other storage commands keep it.
+		{"set b 0 0 4\r\nbbbb\r\n", string(resultStored)},
+		{"prepend b 0 0 37\r\n" + tooLarge[:37] + "\r\n", string(resultServerErrObjectTooLarge)},
+		{"add b 0 0 41\r\n" + tooLarge + "\r\n", string(resultServerErrObjectTooLarge)},
+		{"ms b 41 MA\r\n" + tooLarge + "\r\n", string(resultServerErrObjectTooLarge)},
+		{"replace c 0 0 41\r\n" + tooLarge + "\r\n", string(resultServerErrObjectTooLarge)},
+		{"set c 0 0 4\r\ncccc\r\n", string(resultStored)},
+		{"cas c 0 0 41 1\r\n" + tooLarge + "\r\n", string(resultServerErrObjectTooLarge)},
+		{"ms c 41 C999\r\n" + tooLarge + "\r\n", string(resultServerErrObjectTooLarge)},
+		{"ms c 40 C999 F1\r\n" + fits + "\r\n", string(resultServerErrObjectTooLarge)},
+		{"get b c\r\n", "VALUE b 0 4\r\nbbbb\r\nVALUE c 0 4\r\ncccc\r\nEND\r\n"},
+		{"ms c 41\r\n" + tooLarge + "\r\n", string(resultServerErrObjectTooLarge)},
+		{"get b c\r\n", "VALUE b 0 4\r\nbbbb\r\nEND\r\n"},
+	}
+	for _, r := range requests {
+		if err := request(conn, r.req, r.want); err != nil {
+			t.Errorf("%q: %v", r.req, err)
+			return
+		}
+	}
+
+	settings, err := readStats(conn, "stats settings\r\n")
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	if settings["item_size_max"] != "100" {
+		t.Errorf("item_size_max: want: %q, got: %q", "100", settings["item_size_max"])
+	}
+}
+
+func TestPipelinedRequests(t *testing.T) {
+	if err := removeAllPreviousData(t); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+
+	conn, err := net.Dial("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	requests := "set key1 0 0 6\r\nvalue1\r\n" +
+		"get key1\r\n" +
+		"add key2 1 0 6\r\nvalue2\r\n" +
+		"gets key1 key2 key3\r\n" +
+		"append key1 0 0 2\r\n!!\r\n" +
+		"delete key2\r\n" +
+		"get key1 key2\r\n" +
+		"incr key1 1\r\n"
+	if _, err := conn.Write([]byte(requests)); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+
+	want := "STORED\r\n" +
+		"VALUE key1 0 6\r\nvalue1\r\nEND\r\n" +
+		"STORED\r\n" +
+		"VALUE key1 0 6 1\r\nvalue1\r\nVALUE key2 1 6 2\r\nvalue2\r\nEND\r\n" +
+		"STORED\r\n" +
+		"DELETED\r\n" +
+		"VALUE key1 0 8\r\nvalue1!!\r\nEND\r\n" +
+		string(resultClientErrIncrDecrNonNumericValue)
+
+	got := make([]byte, len(want))
+	if err := conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Errorf("err: %v, got: %q", err, got)
+		return
+	}
+	if string(got) != want {
+		t.Errorf("want: %q, got: %q", want, got)
+		return
+	}
+}
+
+func TestNoreply(t *testing.T) {
+	if err := removeAllPreviousData(t); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+
+	conn, err := net.Dial("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	requests := "set key1 0 0 1 noreply\r\n1\r\n" +
+		"add key1 0 0 1 noreply\r\n2\r\n" +
+		"replace key1 0 0 1 noreply\r\n3\r\n" +
+		"append key1 0 0 1 noreply\r\n4\r\n" +
+		"prepend key1 0 0 1 noreply\r\n5\r\n" +
+		"cas key1 0 0 1 999 noreply\r\n6\r\n" +
+		"incr key1 10 noreply\r\n" +
+		"decr key1 1 noreply\r\n" +
+		"touch key1 60 noreply\r\n" +
+		"incr key1 abc noreply\r\n" +
+		"delete key2 noreply\r\n" +
+		"verbosity 1 noreply\r\n" +
+		"set key2 0 0 -1 noreply\r\n" +
+		// The data block is followed by the next request instead of "\r\n".
+		"set key2 0 0 2 noreply\r\nabcd" +
+		"set key2 0 0 " + strconv.Itoa(defaultMaxItemSize+1) + " noreply\r\n" + strings.Repeat("a", defaultMaxItemSize+1) + "\r\n" +
+		"get key1\r\n" +
+		"delete key1 noreply\r\n" +
+		"flush_all noreply\r\n" +
+		"get key1\r\n"
+	if _, err := conn.Write([]byte(requests)); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+
+	// Errors are not replied either, so that the client reads the replies of the requests it waits for.
+	want := "VALUE key1 0 3\r\n543\r\nEND\r\n" +
+		"END\r\n"
+
+	got := make([]byte, len(want))
+	if err := conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Errorf("err: %v, got: %q", err, got)
+		return
+	}
+	if string(got) != want {
+		t.Errorf("want: %q, got: %q", want, got)
+		return
+	}
+}
+
+func TestGatSuccess(t *testing.T) {
+	if err := removeAllPreviousData(t); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+
+	key, value := "testKey", "testValue"
+	item := &memcache.Item{
+		Key:        key,
+		Value:      []byte(value),
+		Expiration: 2,
+	}
+
+	if err := mc.Set(item); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+
+	conn, err := net.Dial("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(fmt.Sprintf("%s 60 %s wrongKey\r\n", gatCmd, key))); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+
+	want := fmt.Sprintf("VALUE %s 0 %d\r\n%s\r\nEND\r\n", key, len(value), value)
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	if string(got) != want {
+		t.Errorf("want: %q, got: %q", want, got)
+		return
+	}
+
+	clk.Add(3 * time.Second)
+
+	res, err := mc.Get(key)
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	if err = validateGetItemResult(item, res); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+}
+
+func TestGatsExpires(t *testing.T) {
+	if err := removeAllPreviousData(t); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+
+	key, value := "testKey", "testValue"
+	item := &memcache.Item{
+		Key:   key,
+		Value: []byte(value),
+	}
+
+	if err := mc.Set(item); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+
+	conn, err := net.Dial("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(fmt.Sprintf("%s 2 %s\r\n", gatsCmd, key))); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+
+	want := fmt.Sprintf("VALUE %s 0 %d 1\r\n%s\r\nEND\r\n", key, len(value), value)
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	if string(got) != want {
+		t.Errorf("want: %q, got: %q", want, got)
+		return
+	}
+
+	clk.Add(3 * time.Second)
+
+	if _, err := mc.Get(key); !errors.Is(err, memcache.ErrCacheMiss) {
+		t.Errorf("item must be invalidated. err: %v", err)
+		return
+	}
+}
+
+func TestASCIIAuth(t *testing.T) {
+	m, err := Run(&Config{}, WithClock(clk), WithASCIIAuth(map[string]string{"user": "password"}))
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	defer m.Close()
+
+	conn, err := net.Dial("tcp", fmt.Sprintf(":%d", m.Port()))
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	requests := []struct {
+		req  string
+		want string
+	}{
+		{"get testKey\r\n", string(resultClientErrUnauthenticated)},
+		{"set auth 0 0 10\r\nuser wrong\r\n", string(resultClientErrAuthFailure)},
+		{"set auth 0 0 4\r\nuser\r\n", string(resultClientErrAuthFailure)},
+		{"get testKey\r\n", string(resultClientErrUnauthenticated)},
+		{"set auth 0 0 13\r\nuser password\r\n", string(resultStored)},
+		{"set testKey 0 0 1\r\na\r\n", string(resultStored)},
+		{"get testKey auth\r\n", "VALUE testKey 0 1\r\na\r\nEND\r\n"},
+	}
+	for _, r := range requests {
+		if err := request(conn, r.req, r.want); err != nil {
+			t.Errorf("%q: %v", r.req, err)
+			return
+		}
+	}
+
+	mc := memcache.New(fmt.Sprintf(":%d", m.Port()))
+	if _, err := mc.Get("testKey"); err == nil {
+		t.Errorf("unauthenticated connection must not be served")
+		return
+	}
+
+	// Binary protocol clients cannot bypass the authentication.
+	binaryConn, err := net.Dial("tcp", fmt.Sprintf(":%d", m.Port()))
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	defer binaryConn.Close()
+	if _, err := binaryRoundTrip(binaryConn, &binaryRequest{opcode: opGet, key: "testKey"}); err == nil {
+		t.Errorf("binary protocol connection must not be served")
+	}
+}
+
+func TestQuit(t *testing.T) {
+	conn, err := net.Dial("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	if err := request(conn, "version\r\nquit\r\n", string(resultVersion)); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Errorf("want: %v, got: %v", io.EOF, err)
+	}
+}
+
+func TestVerbosity(t *testing.T) {
+	m, err := Run(&Config{}, WithClock(clk))
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	defer m.Close()
+
+	conn, err := net.Dial("tcp", fmt.Sprintf(":%d", m.Port()))
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	tcs := []struct {
+		req  string
+		want zerolog.Level
+	}{
+		{"verbosity 1\r\n", zerolog.DebugLevel},
+		{"verbosity 5\r\n", zerolog.TraceLevel},
+		{"verbosity 0\r\n", zerolog.InfoLevel},
+	}
+	for _, tc := range tcs {
+		if err := request(conn, tc.req, string(resultOK)); err != nil {
+			t.Errorf("%q: %v", tc.req, err)
+			return
+		}
+		if got := m.logger().GetLevel(); got != tc.want {
+			t.Errorf("%q: want: %v, got: %v", tc.req, tc.want, got)
+		}
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	conn, err := net.Dial("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	defer conn.Close()
+	if err := request(conn, "shutdown\r\n", string(resultErrShutdownNotEnabled)); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+
+	m, err := Run(&Config{}, WithClock(clk), WithShutdownEnabled())
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	conn, err = net.Dial("tcp", fmt.Sprintf(":%d", m.Port()))
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("shutdown\r\n")); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Errorf("want: %v, got: %v", io.EOF, err)
+		return
+	}
+	if _, err := net.Dial("tcp", fmt.Sprintf(":%d", m.Port())); err == nil {
+		t.Errorf("listener must be closed")
+	}
+}
+
+func TestShutdownGraceful(t *testing.T) {
+	m, err := Run(&Config{}, WithClock(clk), WithShutdownEnabled())
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	conn, err := net.Dial("tcp", fmt.Sprintf(":%d", m.Port()))
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	defer conn.Close()
+	other, err := net.Dial("tcp", fmt.Sprintf(":%d", m.Port()))
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	defer other.Close()
+
+	if err := request(other, "set a 0 0 1\r\na\r\n", string(resultStored)); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	if _, err := conn.Write([]byte("shutdown graceful\r\n")); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Errorf("want: %v, got: %v", io.EOF, err)
+		return
+	}
+	if _, err := net.Dial("tcp", fmt.Sprintf(":%d", m.Port())); err == nil {
+		t.Errorf("listener must be closed")
+		return
+	}
+
+	// The other client is served until it disconnects.
+	if err := request(other, "get a\r\n", "VALUE a 0 1\r\na\r\nEND\r\n"); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	_ = other.Close()
+	for i := 0; i < 100; i++ {
+		m.mu.RLock()
+		closed := len(m.items) == 0
+		m.mu.RUnlock()
+		if closed {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("mini-memcached must be closed once every client has disconnected")
+}
@@ -0,0 +1,277 @@
+package minimemcached
+
+import "errors"
+
+const (
+	// itemHeaderSize is the size of the header memcached stores along with each item,
+	// including the CAS token.
+	itemHeaderSize = 56
+	// clientFlagsSize is the size memcached uses to store non-zero client flags.
+	clientFlagsSize = 4
+	// itemStructSize is the size of memcached's item struct, which the smallest chunk adds to the chunk size.
+	itemStructSize = 48
+	// defaultChunkSize is the default space for the key, value and flags of the smallest chunk, as memcached's `-n`.
+	defaultChunkSize = 48
+	// chunkAlignBytes is the alignment of slab chunk sizes.
+	chunkAlignBytes = 8
+	// slabPageSize is the size of a slab page.
+	slabPageSize = 1024 * 1024
+	// defaultGrowthFactor is the default growth factor of slab chunk sizes, as memcached's `-f`.
+	defaultGrowthFactor = 1.25
+	// defaultMaxItemSize is the default largest size of an item, as memcached's default `-I`.
+	defaultMaxItemSize = 1024 * 1024
+	// maxSlabClasses is the maximum number of slab classes, including the unused class 0.
+	maxSlabClasses = 64
+)
+
+// errBadSlabs is returned by Run when the parameters given to WithSlabs cannot make slab classes.
+var errBadSlabs = errors.New("growth factor must be greater than 1, and chunk size must be positive and fit in half a slab page")
+
+// slabAutomove is the mode of the slab automover, set by `slabs automove`.
+type slabAutomove int
+
+const (
+	// automoveOff never moves slab pages.
+	automoveOff slabAutomove = iota
+	// automoveWindow moves a slab page to the slab class which has evicted the most items
+	// every time the LRU maintainer runs.
+	automoveWindow
+	// automoveAggressive moves a slab page to a slab class whenever it would evict an item.
+	automoveAggressive
+)
+
+// reassignResult is the result of `slabs reassign`.
+type reassignResult int
+
+const (
+	reassignOK reassignResult = iota
+	reassignBadClass
+	reassignNoSpare
+	reassignSame
+)
+
+// slabMemory is the memory of a slab class while slab accounting is on.
+type slabMemory struct {
+	// pages is the number of slab pages assigned to the slab class.
+	pages int
+	// usedChunks is the number of chunks used by the items of the slab class.
+	usedChunks int
+	// recentEvictions is the number of items evicted since the slab automover has last run.
+	recentEvictions int
+}
+
+// WithSlabs turns slab accounting on. Items are stored in the chunks of slab classes, whose sizes start from
+// chunkSize bytes for the key, value and flags and grow by factor, as memcached does with `-n` and `-f`.
+// Slab pages of 1MB are assigned to slab classes until MaxBytes is reached, and a slab class evicts its own
+// items once its pages are full, so that a workload whose item sizes change runs out of memory in the same way
+// as memcached. Clients move pages between slab classes with `slabs reassign` and `slabs automove`.
+func WithSlabs(factor float64, chunkSize int) Option {
+	return func(m *MiniMemcached) {
+		m.slabsEnabled = true
+		m.growthFactor = factor
+		m.chunkSize = chunkSize
+	}
+}
+
+// newSlabClasses() returns the chunk sizes of slab classes, computed the way memcached does.
+func newSlabClasses(minSize int, factor float64) []int {
+	classes := []int{0}
+	size := float64(minSize)
+	for len(classes) < maxSlabClasses-1 && int(size) < int(slabPageSize/2/factor) {
+		chunkSize := int(size)
+		if chunkSize%chunkAlignBytes != 0 {
+			chunkSize += chunkAlignBytes - chunkSize%chunkAlignBytes
+		}
+		classes = append(classes, chunkSize)
+		size = float64(chunkSize) * factor
+	}
+	return append(classes, slabPageSize/2)
+}
+
+// initSlabs() computes the slab classes from the growth factor and the chunk size.
+func (m *MiniMemcached) initSlabs() error {
+	if m.growthFactor <= 1 || m.chunkSize <= 0 || itemStructSize+m.chunkSize > slabPageSize/2 {
+		return errBadSlabs
+	}
+	m.slabClasses = newSlabClasses(itemStructSize+m.chunkSize, m.growthFactor)
+	m.slabs = make([]slabMemory, len(m.slabClasses))
+	return nil
+}
+
+// slabClassID() returns the id of the smallest slab class which can store an item of size.
+// Items larger than the largest chunk belong to the largest slab class.
+func (m *MiniMemcached) slabClassID(size int) int {
+	for id := 1; id < len(m.slabClasses); id++ {
+		if size <= m.slabClasses[id] {
+			return id
+		}
+	}
+	return len(m.slabClasses) - 1
+}
+
+// chunks() returns the number of chunks of slab class id used by an item of size.
+// Only items larger than the largest chunk use more than one chunk.
+func (m *MiniMemcached) chunks(id, size int) int {
+	return (size + m.slabClasses[id] - 1) / m.slabClasses[id]
+}
+
+// chunksPerPage() returns the number of chunks of slab class id in a slab page.
+func (m *MiniMemcached) chunksPerPage(id int) int {
+	return slabPageSize / m.slabClasses[id]
+}
+
+// size() returns the number of bytes memcached would use to store item under key.
+func (i *item) size(key string) int {
+	size := itemHeaderSize + len(key) + 1 + len(i.value) + len(crlf)
+	if i.flags != 0 {
+		size += clientFlagsSize
+	}
+	return size
+}
+
+// addChunks() adds the chunks used by an item of size sign times to its slab class.
+// The caller must hold the mutex of MiniMemcached.
+func (m *MiniMemcached) addChunks(size int, sign int) {
+	id := m.slabClassID(size)
+	m.slabs[id].usedChunks += sign * m.chunks(id, size)
+}
+
+// reserveChunks() makes room for an item of size in its slab class, and reports whether the item fits.
+// The slab class takes a page from the global page pool or a newly allocated one, and then, when MaxBytes
+// has been reached, evicts its own least recently used items. A slab class with no page may always
+// allocate its first page, as in memcached.
+// The caller must hold the mutex of MiniMemcached.
+func (m *MiniMemcached) reserveChunks(size int) bool {
+	id := m.slabClassID(size)
+	s := &m.slabs[id]
+	need := m.chunks(id, size)
+	now := m.clock.Now().Unix()
+	for s.usedChunks+need > s.pages*m.chunksPerPage(id) {
+		if m.allocatePage(id) {
+			continue
+		}
+		if m.evictionsDisabled {
+			break
+		}
+		if m.slabAutomove == automoveAggressive && m.reassign(-1, id) == reassignOK {
+			continue
+		}
+		key, it := m.lruTail(id)
+		if it == nil {
+			break
+		}
+		m.evictItem(key, it, now)
+	}
+	if s.usedChunks+need > s.pages*m.chunksPerPage(id) {
+		m.classCounters(id).outOfMemory++
+		return false
+	}
+	return true
+}
+
+// allocatePage() assigns a page from the global page pool, or a newly allocated one, to slab class id,
+// and reports whether a page has been assigned. The caller must hold the mutex of MiniMemcached.
+func (m *MiniMemcached) allocatePage(id int) bool {
+	switch {
+	case m.slabGlobalPages > 0:
+		m.slabGlobalPages--
+	case m.maxBytes == 0 || int64(m.slabPagesMalloced+1)*slabPageSize <= m.maxBytes || m.slabs[id].pages == 0:
+		m.slabPagesMalloced++
+	default:
+		return false
+	}
+	m.slabs[id].pages++
+	return true
+}
+
+// lruTail() returns the least recently used item of slab class id, looking at COLD first, and then HOT and WARM.
+// It returns a nil item when the slab class has no item. The caller must hold the mutex of MiniMemcached.
+func (m *MiniMemcached) lruTail(id int) (string, *item) {
+	for _, segment := range []lruSegment{coldLRU, hotLRU, warmLRU} {
+		for e := m.lrus[segment].Back(); e != nil; e = e.Prev() {
+			key := e.Value.(string)
+			if it := m.items[key]; m.slabClassID(it.size(key)) == id {
+				return key, it
+			}
+		}
+	}
+	return "", nil
+}
+
+// reassign() moves a slab page from slab class src to slab class dst, as `slabs reassign` does.
+// A src of -1 takes the page from any other slab class with a spare page, and a dst of 0 returns the page
+// to the global page pool. The slab class losing the page evicts the items which no longer fit in it.
+// The caller must hold the mutex of MiniMemcached.
+func (m *MiniMemcached) reassign(src, dst int) reassignResult {
+	if dst < 0 || dst >= len(m.slabClasses) || src != -1 && (src < 1 || src >= len(m.slabClasses)) {
+		return reassignBadClass
+	}
+	if src == -1 {
+		if src = m.spareSlabClass(dst); src == 0 {
+			return reassignNoSpare
+		}
+	}
+	if src == dst {
+		return reassignSame
+	}
+	if m.slabs[src].pages < 2 {
+		return reassignNoSpare
+	}
+
+	m.slabs[src].pages--
+	if dst == 0 {
+		m.slabGlobalPages++
+	} else {
+		m.slabs[dst].pages++
+	}
+	m.counters.slabsMoved++
+
+	now := m.clock.Now().Unix()
+	for m.slabs[src].usedChunks > m.slabs[src].pages*m.chunksPerPage(src) {
+		key, it := m.lruTail(src)
+		if it.expired(now) {
+			m.reclaim(key)
+			continue
+		}
+		m.counters.slabReassignEvictionsNomem++
+		m.unlink(key)
+	}
+	return reassignOK
+}
+
+// spareSlabClass() returns the id of the slab class other than dst with the most pages, which must have
+// a spare one. It returns 0 when no slab class has a spare page. The caller must hold the mutex of MiniMemcached.
+func (m *MiniMemcached) spareSlabClass(dst int) int {
+	src := 0
+	for id := 1; id < len(m.slabs); id++ {
+		if id != dst && m.slabs[id].pages >= 2 && (src == 0 || m.slabs[id].pages > m.slabs[src].pages) {
+			src = id
+		}
+	}
+	return src
+}
+
+// automoveSlabs() moves a slab page to the slab class which has evicted the most items since the last run,
+// from the slab class with the most pages, when the slab automover is automoveWindow.
+// The caller must hold the mutex of MiniMemcached.
+func (m *MiniMemcached) automoveSlabs() {
+	dst := 0
+	for id := 1; id < len(m.slabs); id++ {
+		if m.slabs[id].recentEvictions > 0 && (dst == 0 || m.slabs[id].recentEvictions > m.slabs[dst].recentEvictions) {
+			dst = id
+		}
+	}
+	for id := range m.slabs {
+		m.slabs[id].recentEvictions = 0
+	}
+	if dst != 0 && m.slabAutomove == automoveWindow {
+		m.reassign(-1, dst)
+	}
+}
+
+// setSlabAutomove() sets the mode of the slab automover.
+func (m *MiniMemcached) setSlabAutomove(mode slabAutomove) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.slabAutomove = mode
+}
@@ -0,0 +1,179 @@
+package minimemcached
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// With a growth factor of 2, items of 150000 bytes are stored in slab class 12, whose chunks of 196608 bytes
+// fit 5 in a slab page, and items of 300000 bytes in slab class 13, whose chunks of 524288 bytes fit 2.
+const (
+	slabsTestMediumValue = 150000
+	slabsTestLargeValue  = 300000
+)
+
+// slabsTestSet returns a `set` request storing a value of size bytes under key.
+func slabsTestSet(key string, size int) string {
+	return fmt.Sprintf("set %s 0 0 %d\r\n%s\r\n", key, size, strings.Repeat("v", size))
+}
+
+func TestWithSlabs(t *testing.T) {
+	if _, err := Run(&Config{}, WithClock(clk), WithSlabs(1, defaultChunkSize)); err != errBadSlabs {
+		t.Errorf("want: %v, got: %v", errBadSlabs, err)
+		return
+	}
+	if _, err := Run(&Config{}, WithClock(clk), WithSlabs(defaultGrowthFactor, 0)); err != errBadSlabs {
+		t.Errorf("want: %v, got: %v", errBadSlabs, err)
+		return
+	}
+
+	m, err := Run(&Config{}, WithClock(clk))
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	defer m.Close()
+
+	conn, err := net.Dial("tcp", fmt.Sprintf(":%d", m.Port()))
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	if err := request(conn, "slabs reassign 1 2\r\n", string(resultClientErrSlabReassignDisabled)); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	settings, err := readStats(conn, "stats settings\r\n")
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	if settings["slab_reassign"] != "no" || settings["growth_factor"] != "1.25" || settings["chunk_size"] != "48" {
+		t.Errorf("unexpected settings: %v", settings)
+	}
+}
+
+func TestSlabs(t *testing.T) {
+	m, err := Run(&Config{MaxBytes: 2 * slabPageSize}, WithClock(clk), WithSlabs(2, defaultChunkSize))
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	defer m.Close()
+
+	conn, err := net.Dial("tcp", fmt.Sprintf(":%d", m.Port()))
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	requests := []struct {
+		req  string
+		want string
+	}{
+		// Slab class 13 takes both pages of the memory limit, and then evicts its own items.
+		{slabsTestSet("a", slabsTestLargeValue), string(resultStored)},
+		{slabsTestSet("b", slabsTestLargeValue), string(resultStored)},
+		{slabsTestSet("c", slabsTestLargeValue), string(resultStored)},
+		{slabsTestSet("d", slabsTestLargeValue), string(resultStored)},
+		{slabsTestSet("e", slabsTestLargeValue), string(resultStored)},
+		{"mg a u\r\n", metaMiss + "\r\n"},
+		// Slab class 12 may allocate its first page over the limit, but no more.
+		{slabsTestSet("f1", slabsTestMediumValue), string(resultStored)},
+		{slabsTestSet("f2", slabsTestMediumValue), string(resultStored)},
+		{slabsTestSet("f3", slabsTestMediumValue), string(resultStored)},
+		{slabsTestSet("f4", slabsTestMediumValue), string(resultStored)},
+		{slabsTestSet("f5", slabsTestMediumValue), string(resultStored)},
+		{slabsTestSet("f6", slabsTestMediumValue), string(resultStored)},
+		{"mg f1 u\r\n", metaMiss + "\r\n"},
+		// Moving a page from slab class 13 evicts the items which no longer fit in it.
+		{"slabs reassign 13 12\r\n", string(resultOK)},
+		{"mg b u\r\n", metaMiss + "\r\n"},
+		{"mg c u\r\n", metaMiss + "\r\n"},
+		{"mg d u\r\n", metaHit + "\r\n"},
+		{"slabs reassign 13 12\r\n", string(resultNoSpare)},
+		{"slabs reassign 12 12\r\n", string(resultSame)},
+		{"slabs reassign 0 12\r\n", string(resultBadClass)},
+		{"slabs reassign 12 14\r\n", string(resultBadClass)},
+		{"slabs reassign a 12\r\n", string(resultClientErrBadCliFormat)},
+		{"slabs reassign 12\r\n", string(resultErr)},
+		{"slabs automove 3\r\n", string(resultErr)},
+		// The aggressive automover takes a page from another slab class instead of evicting.
+		{"slabs automove 2\r\n", string(resultOK)},
+		{slabsTestSet("g", slabsTestLargeValue), string(resultStored)},
+		{"mg d u\r\n", metaHit + "\r\n"},
+		{"mg f2 u\r\n", metaHit + "\r\n"},
+	}
+	for i, r := range requests {
+		if err := request(conn, r.req, r.want); err != nil {
+			t.Errorf("request %d: %v", i, err)
+			return
+		}
+	}
+
+	stats, err := readStats(conn, "stats\r\n")
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	for name, value := range map[string]string{"evictions": "2", "slabs_moved": "2", "slab_reassign_evictions_nomem": "2", "slab_global_page_pool": "0"} {
+		if stats[name] != value {
+			t.Errorf("%s: want: %q, got: %q", name, value, stats[name])
+		}
+	}
+	slabs, err := readStats(conn, "stats slabs\r\n")
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	for name, value := range map[string]string{
+		"12:total_pages": "1", "12:used_chunks": "5", "12:free_chunks": "0",
+		"13:total_pages": "2", "13:used_chunks": "3", "13:chunk_size": "524288",
+		"active_slabs": "2", "total_malloced": fmt.Sprint(3 * slabPageSize),
+	} {
+		if slabs[name] != value {
+			t.Errorf("%s: want: %q, got: %q", name, value, slabs[name])
+		}
+	}
+
+	// The automover moves a page to the slab class which has evicted the most items, as the clock goes.
+	for i, r := range []struct {
+		req  string
+		want string
+	}{
+		{"slabs automove 1\r\n", string(resultOK)},
+		{slabsTestSet("f7", slabsTestMediumValue), string(resultStored)},
+		{slabsTestSet("f8", slabsTestMediumValue), string(resultStored)},
+		{"mg f2 u\r\n", metaMiss + "\r\n"},
+		{"mg f3 u\r\n", metaMiss + "\r\n"},
+	} {
+		if err := request(conn, r.req, r.want); err != nil {
+			t.Errorf("request %d: %v", i, err)
+			return
+		}
+	}
+	clk.Add(lruMaintainerInterval)
+	for i := 0; i < 100; i++ {
+		if stats, err = readStats(conn, "stats\r\n"); err != nil || stats["slabs_moved"] == "3" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats["slabs_moved"] != "3" || stats["slab_reassign_evictions_nomem"] != "3" {
+		t.Errorf("unexpected stats: %v", stats)
+	}
+	settings, err := readStats(conn, "stats settings\r\n")
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	if settings["slab_reassign"] != "yes" || settings["slab_automove"] != "1" || settings["growth_factor"] != "2.00" {
+		t.Errorf("unexpected settings: %v", settings)
+	}
+}
@@ -0,0 +1,376 @@
+package minimemcached
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"sync/atomic"
+)
+
+// sizesBucket is the width of the buckets of the item size histogram reported by `stats sizes`.
+const sizesBucket = 32
+
+// stat is a single statistic reported by mini-memcached.
+type stat struct {
+	name  string
+	value string
+}
+
+// counters are the statistics counted by the commands served by mini-memcached.
+// They are guarded by the mutex of MiniMemcached.
+type counters struct {
+	totalItems          uint64
+	totalConnections    uint64
+	rejectedConnections uint64
+	cmdGet              uint64
+	cmdSet              uint64
+	cmdFlush            uint64
+	cmdTouch            uint64
+	getHits             uint64
+	getMisses           uint64
+	getExpired          uint64
+	deleteHits          uint64
+	deleteMisses        uint64
+	incrHits            uint64
+	incrMisses          uint64
+	decrHits            uint64
+	decrMisses          uint64
+	casHits             uint64
+	casMisses           uint64
+	casBadval           uint64
+	touchHits           uint64
+	touchMisses         uint64
+	evictions           uint64
+	expiredUnfetched    uint64
+	evictedUnfetched    uint64
+	movesToCold         uint64
+	movesToWarm         uint64
+	movesWithinLRU      uint64
+	slabsMoved          uint64
+	// slabReassignEvictionsNomem is the number of items evicted by moving slab pages.
+	slabReassignEvictionsNomem uint64
+}
+
+// slabClassCounters are the statistics counted for each slab class.
+// They are guarded by the mutex of MiniMemcached.
+type slabClassCounters struct {
+	evicted          uint64
+	evictedNonzero   uint64
+	evictedTime      int64
+	evictedUnfetched uint64
+	outOfMemory      uint64
+	reclaimed        uint64
+	expiredUnfetched uint64
+	movesToCold      uint64
+	movesToWarm      uint64
+	movesWithinLRU   uint64
+}
+
+// classCounters() returns the counters of the slab class id.
+// The caller must hold the mutex of MiniMemcached.
+func (m *MiniMemcached) classCounters(id int) *slabClassCounters {
+	c := m.slabClassCounters[id]
+	if c == nil {
+		c = &slabClassCounters{}
+		m.slabClassCounters[id] = c
+	}
+	return c
+}
+
+// generalStats() returns the general-purpose statistics of mini-memcached.
+func (m *MiniMemcached) generalStats() []stat {
+	now := m.clock.Now()
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	c := m.counters
+
+	return []stat{
+		{"pid", strconv.Itoa(os.Getpid())},
+		{"uptime", strconv.FormatInt(int64(now.Sub(m.startedAt).Seconds()), 10)},
+		{"time", strconv.FormatInt(now.Unix(), 10)},
+		{"version", Version},
+		{"pointer_size", strconv.Itoa(strconv.IntSize)},
+		{"max_connections", strconv.Itoa(maxConns)},
+		{"curr_connections", strconv.Itoa(len(m.conns))},
+		{"total_connections", strconv.FormatUint(c.totalConnections, 10)},
+		{"rejected_connections", strconv.FormatUint(c.rejectedConnections, 10)},
+		{"cmd_get", strconv.FormatUint(c.cmdGet, 10)},
+		{"cmd_set", strconv.FormatUint(c.cmdSet, 10)},
+		{"cmd_flush", strconv.FormatUint(c.cmdFlush, 10)},
+		{"cmd_touch", strconv.FormatUint(c.cmdTouch, 10)},
+		{"get_hits", strconv.FormatUint(c.getHits, 10)},
+		{"get_misses", strconv.FormatUint(c.getMisses, 10)},
+		{"get_expired", strconv.FormatUint(c.getExpired, 10)},
+		{"delete_misses", strconv.FormatUint(c.deleteMisses, 10)},
+		{"delete_hits", strconv.FormatUint(c.deleteHits, 10)},
+		{"incr_misses", strconv.FormatUint(c.incrMisses, 10)},
+		{"incr_hits", strconv.FormatUint(c.incrHits, 10)},
+		{"decr_misses", strconv.FormatUint(c.decrMisses, 10)},
+		{"decr_hits", strconv.FormatUint(c.decrHits, 10)},
+		{"cas_misses", strconv.FormatUint(c.casMisses, 10)},
+		{"cas_hits", strconv.FormatUint(c.casHits, 10)},
+		{"cas_badval", strconv.FormatUint(c.casBadval, 10)},
+		{"touch_hits", strconv.FormatUint(c.touchHits, 10)},
+		{"touch_misses", strconv.FormatUint(c.touchMisses, 10)},
+		{"limit_maxbytes", strconv.FormatInt(m.maxBytes, 10)},
+		{"bytes", strconv.FormatInt(m.bytes, 10)},
+		{"curr_items", strconv.Itoa(len(m.items))},
+		{"total_items", strconv.FormatUint(c.totalItems, 10)},
+		{"expired_unfetched", strconv.FormatUint(c.expiredUnfetched, 10)},
+		{"evicted_unfetched", strconv.FormatUint(c.evictedUnfetched, 10)},
+		{"evictions", strconv.FormatUint(c.evictions, 10)},
+		{"moves_to_cold", strconv.FormatUint(c.movesToCold, 10)},
+		{"moves_to_warm", strconv.FormatUint(c.movesToWarm, 10)},
+		{"moves_within_lru", strconv.FormatUint(c.movesWithinLRU, 10)},
+		{"slab_reassign_evictions_nomem", strconv.FormatUint(c.slabReassignEvictionsNomem, 10)},
+		{"slabs_moved", strconv.FormatUint(c.slabsMoved, 10)},
+		{"slab_global_page_pool", strconv.Itoa(m.slabGlobalPages)},
+	}
+}
+
+// statsGroup() returns the statistics of the `stats` sub-command name.
+// An empty name returns the general-purpose statistics. It reports false for an unknown name.
+func (m *MiniMemcached) statsGroup(name string) ([]stat, bool) {
+	switch name {
+	case "":
+		return m.generalStats(), true
+	case "items":
+		return m.itemsStats(), true
+	case "slabs":
+		return m.slabsStats(), true
+	case "sizes":
+		return m.sizesStats(), true
+	case "settings":
+		return m.settingsStats(), true
+	case "conns":
+		return m.connsStats(), true
+	}
+	return nil, false
+}
+
+// slabClassItems are the items stored in a single slab class.
+type slabClassItems struct {
+	number       int
+	memRequested int
+	// numbers are the numbers of items in each LRU segment.
+	numbers [numLRUSegments]int
+	// lastAccessedAt are UNIX timestamps of the time when the least recently accessed item
+	// of each LRU segment has been accessed.
+	lastAccessedAt [numLRUSegments]int64
+}
+
+// itemsBySlabClass() returns the items stored in each slab class, indexed by slab class id.
+// The caller must hold the mutex of MiniMemcached.
+func (m *MiniMemcached) itemsBySlabClass() map[int]*slabClassItems {
+	classes := map[int]*slabClassItems{}
+	for k, it := range m.items {
+		size := it.size(k)
+		id := m.slabClassID(size)
+		class := classes[id]
+		if class == nil {
+			class = &slabClassItems{}
+			classes[id] = class
+		}
+		class.number++
+		class.memRequested += size
+		if class.numbers[it.segment] == 0 || it.lastAccessedAt < class.lastAccessedAt[it.segment] {
+			class.lastAccessedAt[it.segment] = it.lastAccessedAt
+		}
+		class.numbers[it.segment]++
+	}
+	return classes
+}
+
+// itemsStats() returns the statistics of the items stored in each slab class, as `stats items` does.
+// Only the slab classes which hold items or have counted evictions and reclaims are reported.
+func (m *MiniMemcached) itemsStats() []stat {
+	now := m.clock.Now().Unix()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	classes := m.itemsBySlabClass()
+
+	stats := make([]stat, 0)
+	for id := 1; id < len(m.slabClasses); id++ {
+		class := classes[id]
+		if class == nil {
+			if m.slabClassCounters[id] == nil {
+				continue
+			}
+			class = &slabClassItems{}
+		}
+		// The age of an empty LRU segment is 0, as in memcached.
+		var ages [numLRUSegments]int64
+		for segment, number := range class.numbers {
+			if number != 0 {
+				ages[segment] = now - class.lastAccessedAt[segment]
+			}
+		}
+		c := m.classCounters(id)
+		prefix := fmt.Sprintf("items:%d:", id)
+		stats = append(stats,
+			stat{prefix + "number", strconv.Itoa(class.number)},
+			stat{prefix + "number_hot", strconv.Itoa(class.numbers[hotLRU])},
+			stat{prefix + "number_warm", strconv.Itoa(class.numbers[warmLRU])},
+			stat{prefix + "number_cold", strconv.Itoa(class.numbers[coldLRU])},
+			stat{prefix + "age_hot", strconv.FormatInt(ages[hotLRU], 10)},
+			stat{prefix + "age_warm", strconv.FormatInt(ages[warmLRU], 10)},
+			stat{prefix + "age", strconv.FormatInt(ages[coldLRU], 10)},
+			stat{prefix + "mem_requested", strconv.Itoa(class.memRequested)},
+			stat{prefix + "evicted", strconv.FormatUint(c.evicted, 10)},
+			stat{prefix + "evicted_nonzero", strconv.FormatUint(c.evictedNonzero, 10)},
+			stat{prefix + "evicted_time", strconv.FormatInt(c.evictedTime, 10)},
+			stat{prefix + "outofmemory", strconv.FormatUint(c.outOfMemory, 10)},
+			stat{prefix + "reclaimed", strconv.FormatUint(c.reclaimed, 10)},
+			stat{prefix + "expired_unfetched", strconv.FormatUint(c.expiredUnfetched, 10)},
+			stat{prefix + "evicted_unfetched", strconv.FormatUint(c.evictedUnfetched, 10)},
+			stat{prefix + "moves_to_cold", strconv.FormatUint(c.movesToCold, 10)},
+			stat{prefix + "moves_to_warm", strconv.FormatUint(c.movesToWarm, 10)},
+			stat{prefix + "moves_within_lru", strconv.FormatUint(c.movesWithinLRU, 10)},
+		)
+	}
+	return stats
+}
+
+// slabsStats() returns the statistics of the chunks used in each slab class, as `stats slabs` does.
+// Without slab accounting, pages are counted as if each slab class allocated just enough of them to hold its items.
+func (m *MiniMemcached) slabsStats() []stat {
+	m.mu.RLock()
+	classes := m.itemsBySlabClass()
+	slabs := append([]slabMemory(nil), m.slabs...)
+	slabsEnabled := m.slabsEnabled
+	pagesMalloced := m.slabPagesMalloced
+	m.mu.RUnlock()
+
+	stats := make([]stat, 0)
+	activeSlabs, totalPagesMalloced := 0, 0
+	for id := 1; id < len(m.slabClasses); id++ {
+		class := classes[id]
+		if class == nil {
+			class = &slabClassItems{}
+		}
+		chunksPerPage := m.chunksPerPage(id)
+		totalPages := (slabs[id].usedChunks + chunksPerPage - 1) / chunksPerPage
+		if slabsEnabled {
+			totalPages = slabs[id].pages
+		}
+		if totalPages == 0 {
+			continue
+		}
+		totalChunks := totalPages * chunksPerPage
+		prefix := fmt.Sprintf("%d:", id)
+		stats = append(stats,
+			stat{prefix + "chunk_size", strconv.Itoa(m.slabClasses[id])},
+			stat{prefix + "chunks_per_page", strconv.Itoa(chunksPerPage)},
+			stat{prefix + "total_pages", strconv.Itoa(totalPages)},
+			stat{prefix + "total_chunks", strconv.Itoa(totalChunks)},
+			stat{prefix + "used_chunks", strconv.Itoa(slabs[id].usedChunks)},
+			stat{prefix + "free_chunks", strconv.Itoa(totalChunks - slabs[id].usedChunks)},
+			stat{prefix + "free_chunks_end", "0"},
+			stat{prefix + "mem_requested", strconv.Itoa(class.memRequested)},
+		)
+		activeSlabs++
+		totalPagesMalloced += totalPages
+	}
+	if slabsEnabled {
+		totalPagesMalloced = pagesMalloced
+	}
+	return append(stats,
+		stat{"active_slabs", strconv.Itoa(activeSlabs)},
+		stat{"total_malloced", strconv.Itoa(totalPagesMalloced * slabPageSize)},
+	)
+}
+
+// sizesStats() returns the histogram of item sizes, as `stats sizes` does.
+// Sizes are rounded up to a multiple of sizesBucket, and only non-empty buckets are reported.
+func (m *MiniMemcached) sizesStats() []stat {
+	m.mu.RLock()
+	histogram := map[int]int{}
+	for k, it := range m.items {
+		histogram[(it.size(k)+sizesBucket-1)/sizesBucket*sizesBucket]++
+	}
+	m.mu.RUnlock()
+
+	sizes := make([]int, 0, len(histogram))
+	for size := range histogram {
+		sizes = append(sizes, size)
+	}
+	sort.Ints(sizes)
+	stats := make([]stat, 0, len(sizes))
+	for _, size := range sizes {
+		stats = append(stats, stat{strconv.Itoa(size), strconv.Itoa(histogram[size])})
+	}
+	return stats
+}
+
+// settingsStats() returns the settings mini-memcached is running with, as `stats settings` does.
+// maxbytes is 0 when the memory is not limited.
+func (m *MiniMemcached) settingsStats() []stat {
+	m.mu.RLock()
+	detailEnabled := m.detailEnabled
+	maxBytes := m.maxBytes
+	automove := m.slabAutomove
+	m.mu.RUnlock()
+
+	return []stat{
+		{"maxbytes", strconv.FormatInt(maxBytes, 10)},
+		{"maxconns", strconv.Itoa(maxConns)},
+		{"tcpport", strconv.Itoa(int(m.port))},
+		{"udpport", "0"},
+		{"verbosity", strconv.FormatUint(uint64(atomic.LoadUint32(&m.verbosity)), 10)},
+		{"evictions", onOrOff(!m.evictionsDisabled)},
+		{"growth_factor", strconv.FormatFloat(m.growthFactor, 'f', 2, 64)},
+		{"chunk_size", strconv.Itoa(m.chunkSize)},
+		{"item_size_max", strconv.Itoa(m.maxItemSize)},
+		{"cas_enabled", "yes"},
+		{"binding_protocol", "auto-negotiate"},
+		{"auth_enabled_sasl", yesOrNo(m.saslCredentials != nil)},
+		{"auth_enabled_ascii", yesOrNo(m.asciiCredentials != nil)},
+		{"stat_key_prefix", string(m.prefixDelimiter)},
+		{"detail_enabled", yesOrNo(detailEnabled)},
+		{"shutdown_enabled", yesOrNo(m.shutdownEnabled)},
+		{"lru_segmented", yesOrNo(m.lruSegmented)},
+		{"lru_maintainer_thread", yesOrNo(m.lruSegmented || m.slabsEnabled)},
+		{"hot_lru_pct", strconv.Itoa(hotLRUPercent)},
+		{"warm_lru_pct", strconv.Itoa(warmLRUPercent)},
+		{"slab_reassign", yesOrNo(m.slabsEnabled)},
+		{"slab_automove", strconv.Itoa(int(automove))},
+	}
+}
+
+// resetStats() resets the counters, as `stats reset` does.
+// The statistics of what is currently stored or connected are kept.
+func (m *MiniMemcached) resetStats() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counters = counters{}
+	m.slabClassCounters = map[int]*slabClassCounters{}
+	m.prefixStats = map[string]*PrefixStats{}
+}
+
+// yesOrNo() returns the way memcached reports a boolean setting.
+func yesOrNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// onOrOff() returns the way memcached reports a switch setting.
+func onOrOff(b bool) string {
+	if b {
+		return "on"
+	}
+	return "off"
+}
+
+// writeStats() writes stats as memcached `STAT <name> <value>` lines, followed by END.
+func writeStats(stats []stat, w io.Writer) {
+	result := make([]byte, 0)
+	for _, s := range stats {
+		result = append(result, []byte(fmt.Sprintf("%s %s %s\r\n", statPrefix, s.name, s.value))...)
+	}
+	result = append(result, resultEnd...)
+	_, _ = w.Write(result)
+}
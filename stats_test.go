@@ -0,0 +1,479 @@
+package minimemcached
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// readStats() sends req and returns the statistics replied with STAT lines until END.
+func readStats(conn net.Conn, req string) (map[string]string, error) {
+	if _, err := conn.Write([]byte(req)); err != nil {
+		return nil, err
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		return nil, err
+	}
+
+	stats := map[string]string{}
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSuffix(line, "\r\n")
+		if line == "END" {
+			return stats, nil
+		}
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) != 3 || fields[0] != statPrefix {
+			return nil, fmt.Errorf("unexpected line: %q", line)
+		}
+		stats[fields[1]] = fields[2]
+	}
+}
+
+func TestStats(t *testing.T) {
+	m, err := Run(&Config{}, WithClock(clk))
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	defer m.Close()
+
+	conn, err := net.Dial("tcp", fmt.Sprintf(":%d", m.Port()))
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	c := memcache.New(fmt.Sprintf(":%d", m.Port()))
+	if err := c.Set(&memcache.Item{Key: "counter", Value: []byte("1")}); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	if err := c.Set(&memcache.Item{Key: "expiring", Value: []byte("value"), Expiration: 10}); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	if _, err := c.Get("counter"); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	if _, err := c.Get("missing"); err != memcache.ErrCacheMiss {
+		t.Errorf("want: %v, got: %v", memcache.ErrCacheMiss, err)
+		return
+	}
+	if _, err := c.Increment("counter", 1); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	if _, err := c.Decrement("missing", 1); err != memcache.ErrCacheMiss {
+		t.Errorf("want: %v, got: %v", memcache.ErrCacheMiss, err)
+		return
+	}
+	if err := c.Touch("counter", 100); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	if err := c.CompareAndSwap(&memcache.Item{Key: "counter", Value: []byte("3")}); err != memcache.ErrCASConflict {
+		t.Errorf("want: %v, got: %v", memcache.ErrCASConflict, err)
+		return
+	}
+	if err := c.Delete("missing"); err != memcache.ErrCacheMiss {
+		t.Errorf("want: %v, got: %v", memcache.ErrCacheMiss, err)
+		return
+	}
+	clk.Add(10 * time.Second)
+	if _, err := c.Get("expiring"); err != memcache.ErrCacheMiss {
+		t.Errorf("want: %v, got: %v", memcache.ErrCacheMiss, err)
+		return
+	}
+
+	stats, err := readStats(conn, "stats\r\n")
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	want := map[string]string{
+		"time":              strconv.FormatInt(clk.Now().Unix(), 10),
+		"uptime":            "10",
+		"version":           Version,
+		"curr_connections":  "2",
+		"total_connections": "2",
+		"cmd_get":           "3",
+		"cmd_set":           "3",
+		"cmd_touch":         "1",
+		"cmd_flush":         "0",
+		"get_hits":          "1",
+		"get_misses":        "2",
+		"get_expired":       "1",
+		"delete_hits":       "0",
+		"delete_misses":     "1",
+		"incr_hits":         "1",
+		"incr_misses":       "0",
+		"decr_hits":         "0",
+		"decr_misses":       "1",
+		"cas_hits":          "0",
+		"cas_misses":        "0",
+		"cas_badval":        "1",
+		"touch_hits":        "1",
+		"touch_misses":      "0",
+		"curr_items":        "1",
+		"total_items":       "2",
+		"bytes":             strconv.Itoa(m.items["counter"].size("counter")),
+		"expired_unfetched": "1",
+		"evictions":         "0",
+	}
+	for name, value := range want {
+		if stats[name] != value {
+			t.Errorf("%s: want: %q, got: %q", name, value, stats[name])
+		}
+	}
+
+	// The hits and misses of `gat` are counted as touches, and TTLs updated by meta commands are not counted.
+	for _, r := range []struct {
+		req  string
+		want string
+	}{
+		{"gat 100 counter missing\r\n", "VALUE counter 0 1\r\n2\r\nEND\r\n"},
+		{"ma counter T100\r\n", "HD\r\n"},
+		{"md counter I T30\r\n", "HD\r\n"},
+	} {
+		if err := request(conn, r.req, r.want); err != nil {
+			t.Errorf("%q: %v", r.req, err)
+			return
+		}
+	}
+	if stats, err = readStats(conn, "stats\r\n"); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	for name, value := range map[string]string{
+		"cmd_get": "5", "get_hits": "1", "get_misses": "2", "cmd_touch": "3", "touch_hits": "2", "touch_misses": "1",
+	} {
+		if stats[name] != value {
+			t.Errorf("%s: want: %q, got: %q", name, value, stats[name])
+		}
+	}
+
+	if err := request(conn, "stats unknown\r\n", string(resultErr)); err != nil {
+		t.Errorf("err: %v", err)
+	}
+}
+
+func TestStatsItemsSlabsSizes(t *testing.T) {
+	m, err := Run(&Config{}, WithClock(clk))
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	defer m.Close()
+
+	conn, err := net.Dial("tcp", fmt.Sprintf(":%d", m.Port()))
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	// Items of 64 bytes belong to the first slab class, and an item of 1056 bytes to the 12th.
+	requests := []struct {
+		req  string
+		want string
+	}{
+		{"set a 0 0 4\r\nabcd\r\n", string(resultStored)},
+		{"set b 0 1 4\r\nabcd\r\n", string(resultStored)},
+		{fmt.Sprintf("set c 0 0 996\r\n%s\r\n", strings.Repeat("c", 996)), string(resultStored)},
+	}
+	for _, r := range requests {
+		if err := request(conn, r.req, r.want); err != nil {
+			t.Errorf("%q: %v", r.req, err)
+			return
+		}
+	}
+	clk.Add(5 * time.Second)
+	if err := request(conn, "get b\r\n", string(resultEnd)); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+
+	tcs := []struct {
+		req  string
+		want map[string]string
+	}{
+		{
+			req: "stats items\r\n",
+			want: map[string]string{
+				"items:1:number":            "1",
+				"items:1:age":               "5",
+				"items:1:mem_requested":     "64",
+				"items:1:reclaimed":         "1",
+				"items:1:expired_unfetched": "1",
+				"items:1:evicted":           "0",
+				"items:1:outofmemory":       "0",
+				"items:12:number":           "1",
+				"items:12:mem_requested":    "1056",
+			},
+		},
+		{
+			req: "stats slabs\r\n",
+			want: map[string]string{
+				"1:chunk_size":      "96",
+				"1:chunks_per_page": "10922",
+				"1:total_pages":     "1",
+				"1:used_chunks":     "1",
+				"1:free_chunks":     "10921",
+				"12:chunk_size":     "1184",
+				"12:used_chunks":    "1",
+				"active_slabs":      "2",
+				"total_malloced":    strconv.Itoa(2 * slabPageSize),
+			},
+		},
+		{
+			req: "stats sizes\r\n",
+			want: map[string]string{
+				"64":   "1",
+				"1056": "1",
+			},
+		},
+	}
+	for _, tc := range tcs {
+		stats, err := readStats(conn, tc.req)
+		if err != nil {
+			t.Errorf("%q: %v", tc.req, err)
+			return
+		}
+		for name, value := range tc.want {
+			if stats[name] != value {
+				t.Errorf("%q: %s: want: %q, got: %q", tc.req, name, value, stats[name])
+			}
+		}
+	}
+}
+
+func TestStatsSettingsConnsReset(t *testing.T) {
+	m, err := Run(&Config{}, WithClock(clk))
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	defer m.Close()
+
+	idle, err := net.Dial("tcp", fmt.Sprintf(":%d", m.Port()))
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	defer idle.Close()
+	conn, err := net.Dial("tcp", fmt.Sprintf(":%d", m.Port()))
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	if err := request(idle, "set a 0 0 1\r\na\r\n", string(resultStored)); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	if err := request(idle, "get a\r\n", "VALUE a 0 1\r\na\r\nEND\r\n"); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	clk.Add(3 * time.Second)
+
+	settings, err := readStats(conn, "stats settings\r\n")
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	if settings["tcpport"] != strconv.Itoa(int(m.Port())) || settings["maxconns"] != "1024" || settings["cas_enabled"] != "yes" {
+		t.Errorf("unexpected settings: %v", settings)
+		return
+	}
+
+	conns, err := readStats(conn, "stats conns\r\n")
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	wantConns := map[string]string{
+		"1:addr":                "tcp:" + idle.LocalAddr().String(),
+		"1:state":               string(connWaiting),
+		"1:secs_since_last_cmd": "3",
+		"2:addr":                "tcp:" + conn.LocalAddr().String(),
+		"2:state":               string(connParseCmd),
+		"2:secs_since_last_cmd": "0",
+	}
+	for name, value := range wantConns {
+		if conns[name] != value {
+			t.Errorf("%s: want: %q, got: %q", name, value, conns[name])
+		}
+	}
+
+	if err := request(conn, "stats reset\r\n", string(resultReset)); err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	stats, err := readStats(conn, "stats\r\n")
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	for name, value := range map[string]string{"cmd_get": "0", "cmd_set": "0", "total_connections": "0", "curr_connections": "2", "curr_items": "1"} {
+		if stats[name] != value {
+			t.Errorf("%s: want: %q, got: %q", name, value, stats[name])
+		}
+	}
+
+	_ = idle.Close()
+	for i := 0; i < 100; i++ {
+		if stats, err = readStats(conn, "stats\r\n"); err != nil || stats["curr_connections"] == "1" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats["curr_connections"] != "1" {
+		t.Errorf("curr_connections: want: %q, got: %q", "1", stats["curr_connections"])
+	}
+}
+
+func TestStatsDetail(t *testing.T) {
+	m, err := Run(&Config{}, WithClock(clk))
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	defer m.Close()
+
+	conn, err := net.Dial("tcp", fmt.Sprintf(":%d", m.Port()))
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	requests := []struct {
+		req  string
+		want string
+	}{
+		{"set profile:1 0 0 1\r\na\r\n", string(resultStored)},
+		{"stats detail on\r\n", string(resultOK)},
+		{"set profile:2 0 0 1\r\na\r\n", string(resultStored)},
+		{"set feed:1 0 0 1\r\na\r\n", string(resultStored)},
+		{"set noprefix 0 0 1\r\na\r\n", string(resultStored)},
+		{"get profile:1 profile:2 profile:3 noprefix\r\n", "VALUE profile:1 0 1\r\na\r\nVALUE profile:2 0 1\r\na\r\nVALUE noprefix 0 1\r\na\r\nEND\r\n"},
+		{"delete feed:1\r\n", string(resultDeleted)},
+		{"stats detail off\r\n", string(resultOK)},
+		{"get feed:1\r\n", string(resultEnd)},
+		{"stats detail dump\r\n", "PREFIX feed get 0 hit 0 set 1 del 1\r\nPREFIX profile get 3 hit 2 set 1 del 0\r\nEND\r\n"},
+		{"stats detail\r\n", string(resultClientErrStatsDetailUsage)},
+		{"stats detail unknown\r\n", string(resultClientErrStatsDetailUsage)},
+	}
+	for _, r := range requests {
+		if err := request(conn, r.req, r.want); err != nil {
+			t.Errorf("%q: %v", r.req, err)
+			return
+		}
+	}
+
+	want := map[string]PrefixStats{
+		"feed":    {Sets: 1, Deletes: 1},
+		"profile": {Gets: 3, Hits: 2, Sets: 1},
+	}
+	got := m.PrefixStats()
+	if len(got) != len(want) {
+		t.Errorf("want: %v, got: %v", want, got)
+		return
+	}
+	for prefix, s := range want {
+		if got[prefix] != s {
+			t.Errorf("%s: want: %+v, got: %+v", prefix, s, got[prefix])
+		}
+	}
+}
+
+func TestWithPrefixDelimiter(t *testing.T) {
+	m, err := Run(&Config{}, WithClock(clk), WithPrefixDelimiter('.'))
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	defer m.Close()
+
+	c := memcache.New(fmt.Sprintf(":%d", m.Port()))
+	if _, err := c.Get("profile.1"); err != memcache.ErrCacheMiss {
+		t.Errorf("want: %v, got: %v", memcache.ErrCacheMiss, err)
+		return
+	}
+	if got := m.PrefixStats()["profile"]; got != (PrefixStats{Gets: 1}) {
+		t.Errorf("want: %+v, got: %+v", PrefixStats{Gets: 1}, got)
+	}
+}
+
+func TestLRUCrawler(t *testing.T) {
+	m, err := Run(&Config{}, WithClock(clk))
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	defer m.Close()
+
+	conn, err := net.Dial("tcp", fmt.Sprintf(":%d", m.Port()))
+	if err != nil {
+		t.Errorf("err: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	now := clk.Now().Unix()
+	large := strings.Repeat("c", 996)
+	requests := []struct {
+		req  string
+		want string
+	}{
+		{"set user:1/a 0 100 1\r\na\r\n", string(resultStored)},
+		{"set b 1 0 1\r\nb\r\n", string(resultStored)},
+		{fmt.Sprintf("set c 0 0 996\r\n%s\r\n", large), string(resultStored)},
+		{"set expired 0 1 1\r\nd\r\n", string(resultStored)},
+		{"get b\r\n", "VALUE b 1 1\r\nb\r\nEND\r\n"},
+	}
+	for _, r := range requests {
+		if err := request(conn, r.req, r.want); err != nil {
+			t.Errorf("%q: %v", r.req, err)
+			return
+		}
+	}
+	clk.Add(time.Second)
+
+	metadump := fmt.Sprintf("key=b exp=-1 la=%d cas=2 fetch=yes cls=1 size=65\n", now) +
+		fmt.Sprintf("key=c exp=-1 la=%d cas=3 fetch=no cls=12 size=1056\n", now) +
+		fmt.Sprintf("key=user%%3A1%%2Fa exp=%d la=%d cas=1 fetch=no cls=1 size=68\n", now+100, now) +
+		"END\r\n"
+	tcs := []struct {
+		req  string
+		want string
+	}{
+		{"lru_crawler metadump all\r\n", metadump},
+		{"lru_crawler metadump hash\r\n", metadump},
+		{"lru_crawler metadump 12\r\n", fmt.Sprintf("key=c exp=-1 la=%d cas=3 fetch=no cls=12 size=1056\nEND\r\n", now)},
+		{"lru_crawler metadump 2,3\r\n", string(resultEnd)},
+		{"lru_crawler metadump 0\r\n", string(resultClientErrBadCliFormat)},
+		{"lru_crawler mgdump all\r\n", "mg b\r\nmg c\r\nmg user:1/a\r\nEN\r\n"},
+		{"lru_crawler unknown all\r\n", string(resultErr)},
+	}
+	for _, tc := range tcs {
+		if err := request(conn, tc.req, tc.want); err != nil {
+			t.Errorf("%q: %v", tc.req, err)
+		}
+	}
+}
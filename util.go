@@ -1,6 +1,11 @@
 package minimemcached
 
-import "strconv"
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
 
 const (
 	asciiDel = 0x7f
@@ -39,3 +44,29 @@ func getNumericValueFromByteArray(value []byte) (uint64, bool) {
 	}
 	return numericValue, true
 }
+
+// uriEncode() percent-encodes every byte of key but the unreserved characters of RFC 3986,
+// as memcached does for the keys it dumps.
+func uriEncode(key string) string {
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '.' || c == '_' || c == '~' {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteString(fmt.Sprintf("%%%02X", c))
+	}
+	return b.String()
+}
+
+// parseNoreply() strips the optional trailing `noreply` token from cmdLine.
+// When the token is present, the returned writer discards every reply, errors included,
+// as memcached does.
+func parseNoreply(cmdLine []string, w io.Writer) ([]string, io.Writer) {
+	if len(cmdLine) == 0 || cmdLine[len(cmdLine)-1] != noreply {
+		return cmdLine, w
+	}
+	return cmdLine[:len(cmdLine)-1], io.Discard
+}